@@ -0,0 +1,358 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/mholt/acmez/v3/acme"
+)
+
+var (
+	ErrAccountDeactivated       = errors.New("the saved ACME account is no longer valid")
+	ErrAccountDirectoryMismatch = errors.New("the saved ACME account belongs to a different ACME directory")
+)
+
+// savedAccount is what gets written to disk for each ACME directory. The
+// private key is stored separately in acme.apk.
+type savedAccount struct {
+	acme.Account
+	DirectoryURL string `json:"directoryURL"`
+}
+
+// loadOrRegisterAccount returns the account saved by a previous run for the
+// configured directory. If there is none, or the account key was just
+// generated, it registers a new account, bound to an external account when
+// EAB credentials are configured, and saves it so the EAB credentials are not
+// needed again.
+func (s *ProvisionCommand) loadOrRegisterAccount(ctx context.Context, client *acme.Client) (acme.Account, error) {
+	if !s.createAccount {
+		account, err := readAccount(s.configDir, s.acmeURL)
+		if err == nil {
+			account.PrivateKey = s.accountPrivateKey
+			return account, nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return acme.Account{}, err
+		}
+	}
+
+	account := acme.Account{
+		Contact:              []string{fmt.Sprintf("mailto:%s", s.accountEmail)},
+		TermsOfServiceAgreed: true,
+		PrivateKey:           s.accountPrivateKey,
+	}
+
+	if s.eab != nil {
+		if err := account.SetExternalAccountBinding(ctx, client, *s.eab); err != nil {
+			return acme.Account{}, fmt.Errorf("could not set external account binding: %w", err)
+		}
+	}
+
+	account, err := client.NewAccount(ctx, account)
+	if err != nil {
+		return acme.Account{}, fmt.Errorf("could not create ACME account: %w", err)
+	}
+
+	slog.Info("registered ACME account", slog.String("location", account.Location), slog.String("directory-url", s.acmeURL))
+	if err = writeAccount(s.configDir, s.acmeURL, account); err != nil {
+		return acme.Account{}, fmt.Errorf("could not save ACME account: %w", err)
+	}
+
+	// the daemon provisions again with the same command
+	s.createAccount = false
+	return account, nil
+}
+
+func newACMEClient(directoryURL string) *acme.Client {
+	return &acme.Client{
+		Directory:   directoryURL,
+		Logger:      slog.Default(),
+		UserAgent:   Name,
+		PollTimeout: time.Minute,
+	}
+}
+
+func accountPath(configDir, directoryURL string) string {
+	sum := sha256.Sum256([]byte(directoryURL))
+	return filepath.Join(configDir, "accounts", hex.EncodeToString(sum[:8])+".json")
+}
+
+// readAccount loads the account saved for directoryURL. It returns an error
+// wrapping fs.ErrNotExist if there is none, and refuses to return accounts
+// that were deactivated or saved for another directory.
+func readAccount(configDir, directoryURL string) (acme.Account, error) {
+	saved, err := readSavedAccount(configDir, directoryURL)
+	if err != nil {
+		return acme.Account{}, err
+	}
+
+	path := accountPath(configDir, directoryURL)
+	if saved.Status != "" && saved.Status != acme.StatusValid {
+		return acme.Account{}, fmt.Errorf("%w: account %s is %s; remove %s to register a new one", ErrAccountDeactivated, saved.Location, saved.Status, path)
+	}
+
+	return saved.Account, nil
+}
+
+// readSavedAccount is readAccount without the status check, for commands that
+// need to report on deactivated accounts too.
+func readSavedAccount(configDir, directoryURL string) (savedAccount, error) {
+	path := accountPath(configDir, directoryURL)
+	accountBytes, err := os.ReadFile(path)
+	if err != nil {
+		return savedAccount{}, err
+	}
+
+	var saved savedAccount
+	if err = json.Unmarshal(accountBytes, &saved); err != nil {
+		return savedAccount{}, fmt.Errorf("could not parse saved ACME account %s: %w", path, err)
+	}
+
+	if saved.DirectoryURL != directoryURL {
+		return savedAccount{}, fmt.Errorf("%w: %s was saved for %s, not %s", ErrAccountDirectoryMismatch, path, saved.DirectoryURL, directoryURL)
+	}
+
+	return saved, nil
+}
+
+func writeAccount(configDir, directoryURL string, account acme.Account) error {
+	// the binding is single use and only needed at registration
+	account.ExternalAccountBinding = nil
+
+	accountBytes, err := json.MarshalIndent(savedAccount{Account: account, DirectoryURL: directoryURL}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := accountPath(configDir, directoryURL)
+	if err = os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, accountBytes, 0o600)
+}
+
+type AccountCommand struct {
+	Show          *AccountShowCommand          `cmd:"" help:"show the ACME account registered with the CA"`
+	UpdateContact *AccountUpdateContactCommand `cmd:"" help:"replace the contact addresses of the ACME account"`
+	RolloverKey   *AccountRolloverKeyCommand   `cmd:"" help:"replace the ACME account key (RFC 8555 key change)"`
+	Deactivate    *AccountDeactivateCommand    `cmd:"" help:"permanently deactivate the ACME account"`
+}
+
+// accountClient holds what every account subcommand needs: the stored account
+// key and a client for the configured directory.
+type accountClient struct {
+	Output string `short:"o" default:"text" enum:"text,json" help:"Output format, text or json"`
+
+	configDir    string
+	acmeURL      string
+	keyPath      string
+	keyType      keyType
+	accountEmail string
+	client       *acme.Client
+}
+
+func (a *accountClient) AfterApply(opts RunOptions) error {
+	a.configDir = filepath.Join(opts.BaseDir, ".config")
+	a.acmeURL = opts.ACMEDirectoryURL
+	a.keyPath = filepath.Join(a.configDir, "acme.apk")
+	a.keyType = keyType(opts.AccountKeyType)
+	a.accountEmail = opts.AccountEmail
+	a.client = newACMEClient(a.acmeURL)
+	return nil
+}
+
+// account returns the account for the stored key as the CA currently sees it.
+func (a *accountClient) account(ctx context.Context) (acme.Account, error) {
+	keyBytes, err := os.ReadFile(a.keyPath)
+	if err != nil {
+		return acme.Account{}, fmt.Errorf("could not read account key, has provision been run? %w", err)
+	}
+
+	key, err := parsePrivateKey(keyBytes)
+	if err != nil {
+		return acme.Account{}, fmt.Errorf("could not parse account key %s: %w", a.keyPath, err)
+	}
+
+	saved, err := readSavedAccount(a.configDir, a.acmeURL)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return acme.Account{}, err
+	}
+
+	// a deactivated account can no longer be looked up on the server, so the
+	// saved copy is all there is
+	if saved.Status == acme.StatusDeactivated || saved.Status == acme.StatusRevoked {
+		saved.PrivateKey = key
+		return saved.Account, nil
+	}
+
+	account, err := a.client.GetAccount(ctx, acme.Account{PrivateKey: key})
+	if err != nil {
+		return acme.Account{}, fmt.Errorf("could not look up ACME account: %w", err)
+	}
+
+	return account, a.save(account)
+}
+
+func (a *accountClient) save(account acme.Account) error {
+	return writeAccount(a.configDir, a.acmeURL, account)
+}
+
+func (a *accountClient) print(w io.Writer, account acme.Account) error {
+	saved := savedAccount{Account: account, DirectoryURL: a.acmeURL}
+	if a.Output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(saved)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Location:\t%s\n", saved.Location)
+	fmt.Fprintf(tw, "Status:\t%s\n", saved.Status)
+	fmt.Fprintf(tw, "Contact:\t%s\n", strings.Join(saved.Contact, ", "))
+	fmt.Fprintf(tw, "Directory:\t%s\n", saved.DirectoryURL)
+	if kt, err := privateKeyType(account.PrivateKey); err == nil {
+		fmt.Fprintf(tw, "Key type:\t%s\n", kt)
+	}
+	return tw.Flush()
+}
+
+type AccountShowCommand struct {
+	accountClient `embed:""`
+}
+
+func (c *AccountShowCommand) Run(ctx context.Context, kctx *kong.Context) error {
+	account, err := c.account(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.print(kctx.Stdout, account)
+}
+
+type AccountUpdateContactCommand struct {
+	accountClient `embed:""`
+
+	Emails []string `arg:"" optional:"" help:"The new contact email addresses. Defaults to --account-email"`
+}
+
+func (c *AccountUpdateContactCommand) Run(ctx context.Context, kctx *kong.Context) error {
+	account, err := c.account(ctx)
+	if err != nil {
+		return err
+	}
+
+	emails := c.Emails
+	if len(emails) == 0 {
+		emails = []string{c.accountEmail}
+	}
+
+	update := acme.Account{Location: account.Location, PrivateKey: account.PrivateKey}
+	for _, email := range emails {
+		update.Contact = append(update.Contact, "mailto:"+strings.TrimPrefix(email, "mailto:"))
+	}
+
+	account, err = c.client.UpdateAccount(ctx, update)
+	if err != nil {
+		return fmt.Errorf("could not update ACME account contacts: %w", err)
+	}
+
+	if err = c.save(account); err != nil {
+		return err
+	}
+
+	return c.print(kctx.Stdout, account)
+}
+
+type AccountRolloverKeyCommand struct {
+	accountClient `embed:""`
+}
+
+func (c *AccountRolloverKeyCommand) Run(ctx context.Context, kctx *kong.Context) error {
+	account, err := c.account(ctx)
+	if err != nil {
+		return err
+	}
+
+	newKey, err := generatePrivateKey(c.keyType, rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	newKeyPEM, err := encodePrivateKey(newKey)
+	if err != nil {
+		return err
+	}
+
+	// keep the new key on disk before the CA switches to it, so a failure
+	// after the rollover cannot lock us out of the account
+	pendingPath := c.keyPath + ".new"
+	if err = os.WriteFile(pendingPath, newKeyPEM, 0o400); err != nil {
+		return fmt.Errorf("could not save new account key: %w", err)
+	}
+
+	account, err = c.client.AccountKeyRollover(ctx, account, newKey)
+	if err != nil {
+		os.Remove(pendingPath)
+		return fmt.Errorf("could not roll over account key: %w", err)
+	}
+
+	if err = os.Rename(pendingPath, c.keyPath); err != nil {
+		return fmt.Errorf("account key was rolled over but could not be moved into place, rename %s to %s manually: %w", pendingPath, c.keyPath, err)
+	}
+
+	others, _ := filepath.Glob(filepath.Join(c.configDir, "accounts", "*.json"))
+	if len(others) > 1 {
+		slog.Warn("the account key is shared with accounts at other ACME directories, which now need their own rollover or a new registration",
+			slog.Any("accounts", others))
+	}
+
+	return c.print(kctx.Stdout, account)
+}
+
+type AccountDeactivateCommand struct {
+	accountClient `embed:""`
+
+	Yes bool `help:"Confirm the deactivation, which cannot be undone"`
+}
+
+func (c *AccountDeactivateCommand) Run(ctx context.Context, kctx *kong.Context) error {
+	if !c.Yes {
+		return errors.New("deactivating an ACME account cannot be undone, pass --yes to confirm")
+	}
+
+	account, err := c.account(ctx)
+	if err != nil {
+		return err
+	}
+
+	account, err = c.client.UpdateAccount(ctx, acme.Account{
+		Status:     acme.StatusDeactivated,
+		Location:   account.Location,
+		PrivateKey: account.PrivateKey,
+	})
+	if err != nil {
+		return fmt.Errorf("could not deactivate ACME account: %w", err)
+	}
+
+	if err = c.save(account); err != nil {
+		return err
+	}
+
+	return c.print(kctx.Stdout, account)
+}
@@ -0,0 +1,364 @@
+package app
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/mholt/acmez/v3/acme"
+	. "github.com/onsi/gomega"
+)
+
+func TestSavedAccounts(t *testing.T) {
+	RegisterTestingT(t)
+
+	const (
+		prodURL    = "https://acme.example/directory"
+		stagingURL = "https://acme-staging.example/directory"
+	)
+
+	dir := t.TempDir()
+	_, err := readAccount(dir, prodURL)
+	Expect(err).To(MatchError(fs.ErrNotExist))
+
+	account := acme.Account{
+		Status:                 acme.StatusValid,
+		Contact:                []string{"mailto:ops@example.com"},
+		Location:               "https://acme.example/acct/1",
+		ExternalAccountBinding: json.RawMessage(`{"protected":"x"}`),
+	}
+	Expect(writeAccount(dir, prodURL, account)).To(Succeed())
+
+	saved, err := readAccount(dir, prodURL)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(saved.Location).To(Equal(account.Location))
+	Expect(saved.Contact).To(Equal(account.Contact))
+	Expect(saved.ExternalAccountBinding).To(BeEmpty())
+
+	_, err = readAccount(dir, stagingURL)
+	Expect(err).To(MatchError(fs.ErrNotExist))
+
+	// a file copied from another directory's slot is rejected
+	prodBytes, err := os.ReadFile(accountPath(dir, prodURL))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(os.WriteFile(accountPath(dir, stagingURL), prodBytes, 0o600)).To(Succeed())
+	_, err = readAccount(dir, stagingURL)
+	Expect(err).To(MatchError(ErrAccountDirectoryMismatch))
+
+	account.Status = acme.StatusDeactivated
+	Expect(writeAccount(dir, prodURL, account)).To(Succeed())
+	_, err = readAccount(dir, prodURL)
+	Expect(err).To(MatchError(ErrAccountDeactivated))
+}
+
+// fakeACMEServer is just enough of an ACME server for the account commands:
+// one account, registered to the first key that looks it up.
+type fakeACMEServer struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	key           testJWK
+	status        string
+	failKeyChange bool
+}
+
+// testJWK holds the public key fields of a JWK, so keys can be compared.
+type testJWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type testJWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+}
+
+// decode returns the key or key ID the JWS was signed with, and its payload.
+func (j testJWS) decode() (key testJWK, kid string, payload []byte, err error) {
+	header, err := base64.RawURLEncoding.DecodeString(j.Protected)
+	if err != nil {
+		return testJWK{}, "", nil, err
+	}
+
+	var protected struct {
+		JWK *testJWK `json:"jwk"`
+		KID string   `json:"kid"`
+	}
+	if err = json.Unmarshal(header, &protected); err != nil {
+		return testJWK{}, "", nil, err
+	}
+
+	if protected.JWK != nil {
+		key = *protected.JWK
+	}
+
+	payload, err = base64.RawURLEncoding.DecodeString(j.Payload)
+	return key, protected.KID, payload, err
+}
+
+func newFakeACMEServer(t *testing.T) *fakeACMEServer {
+	f := &fakeACMEServer{status: acme.StatusValid}
+	mux := http.NewServeMux()
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.Close)
+
+	mux.HandleFunc("GET /directory", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   f.URL + "/nonce",
+			"newAccount": f.URL + "/new-account",
+			"newOrder":   f.URL + "/new-order",
+			"revokeCert": f.URL + "/revoke-cert",
+			"keyChange":  f.URL + "/key-change",
+		})
+	})
+
+	mux.HandleFunc("HEAD /nonce", func(w http.ResponseWriter, r *http.Request) {})
+
+	mux.HandleFunc("POST /new-account", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		key, _, _, err := readTestJWS(r.Body)
+		if err != nil {
+			f.problem(w, "malformed", err.Error())
+			return
+		}
+
+		if f.key == (testJWK{}) {
+			f.key = key
+		}
+
+		if key != f.key {
+			f.problem(w, "accountDoesNotExist", "no account for this key")
+			return
+		}
+
+		f.account(w)
+	})
+
+	mux.HandleFunc("POST /account", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		_, kid, payload, err := readTestJWS(r.Body)
+		if err != nil || kid != f.URL+"/account" {
+			f.problem(w, "malformed", fmt.Sprintf("bad account request for %q: %v", kid, err))
+			return
+		}
+
+		var update acme.Account
+		if err = json.Unmarshal(payload, &update); err == nil && update.Status != "" {
+			f.status = update.Status
+		}
+
+		f.account(w)
+	})
+
+	mux.HandleFunc("POST /key-change", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if f.failKeyChange {
+			f.problem(w, "serverInternal", "key change failed")
+			return
+		}
+
+		// the payload is a JWS signed by the new key, naming the old one
+		_, _, payload, err := readTestJWS(r.Body)
+		if err != nil {
+			f.problem(w, "malformed", err.Error())
+			return
+		}
+
+		newKey, _, inner, err := readTestJWS(bytes.NewReader(payload))
+		if err != nil {
+			f.problem(w, "malformed", err.Error())
+			return
+		}
+
+		var change struct {
+			Account string  `json:"account"`
+			OldKey  testJWK `json:"oldKey"`
+		}
+		if err = json.Unmarshal(inner, &change); err != nil || change.Account != f.URL+"/account" || change.OldKey != f.key {
+			f.problem(w, "malformed", fmt.Sprintf("bad key change: %s", inner))
+			return
+		}
+
+		f.key = newKey
+	})
+
+	return f
+}
+
+func readTestJWS(r io.Reader) (testJWK, string, []byte, error) {
+	var jws testJWS
+	if err := json.NewDecoder(r).Decode(&jws); err != nil {
+		return testJWK{}, "", nil, err
+	}
+
+	return jws.decode()
+}
+
+func (f *fakeACMEServer) account(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", f.URL+"/account")
+	json.NewEncoder(w).Encode(acme.Account{Status: f.status, Contact: []string{"mailto:admin@example.com"}})
+}
+
+func (f *fakeACMEServer) problem(w http.ResponseWriter, problemType, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(acme.Problem{Type: "urn:ietf:params:acme:error:" + problemType, Detail: detail})
+}
+
+// runAccountCommand runs an account subcommand against server, with an
+// account key already in baseDir, and returns what it printed.
+func runAccountCommand(baseDir string, server *fakeACMEServer, args ...string) (string, error) {
+	kctx, parsed, err := parseTestCommandLine(baseDir, append([]string{
+		"--acme-directory-url", server.URL + "/directory", "account",
+	}, args...)...)
+	Expect(err).NotTo(HaveOccurred())
+
+	var out bytes.Buffer
+	kctx.Stdout = &out
+	err = kctx.Run(parsed.RunOptions)
+	return out.String(), err
+}
+
+func writeTestAccountKey(baseDir string) string {
+	key, err := generatePrivateKey(keyTypeEC256, rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	keyPEM, err := encodePrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	keyPath := filepath.Join(baseDir, ".config", "acme.apk")
+	Expect(os.MkdirAll(filepath.Dir(keyPath), 0o700)).To(Succeed())
+	Expect(os.WriteFile(keyPath, keyPEM, 0o400)).To(Succeed())
+	return keyPath
+}
+
+func TestAccountShow(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := t.TempDir()
+	server := newFakeACMEServer(t)
+	writeTestAccountKey(dir)
+
+	out, err := runAccountCommand(dir, server, "show")
+	Expect(err).NotTo(HaveOccurred())
+	Expect(out).To(ContainSubstring(server.URL + "/account"))
+	Expect(out).To(ContainSubstring("mailto:admin@example.com"))
+
+	saved, err := readAccount(filepath.Join(dir, ".config"), server.URL+"/directory")
+	Expect(err).NotTo(HaveOccurred())
+	Expect(saved.Location).To(Equal(server.URL + "/account"))
+
+	out, err = runAccountCommand(dir, server, "show", "--output", "json")
+	Expect(err).NotTo(HaveOccurred())
+	var printed savedAccount
+	Expect(json.Unmarshal([]byte(out), &printed)).To(Succeed())
+	Expect(printed.DirectoryURL).To(Equal(server.URL + "/directory"))
+}
+
+func TestAccountShowRejectsOtherDirectory(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := t.TempDir()
+	server := newFakeACMEServer(t)
+	writeTestAccountKey(dir)
+
+	// an account saved for another directory, copied into this one's slot
+	configDir := filepath.Join(dir, ".config")
+	Expect(writeAccount(configDir, "https://acme.example/directory", acme.Account{Location: "https://acme.example/acct/1"})).To(Succeed())
+	accountBytes, err := os.ReadFile(accountPath(configDir, "https://acme.example/directory"))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(os.WriteFile(accountPath(configDir, server.URL+"/directory"), accountBytes, 0o600)).To(Succeed())
+
+	for _, args := range [][]string{{"show"}, {"rollover-key"}, {"deactivate", "--yes"}} {
+		_, err = runAccountCommand(dir, server, args...)
+		Expect(err).To(MatchError(ErrAccountDirectoryMismatch), "account %v", args)
+	}
+
+	// the server never heard of the account
+	Expect(server.key).To(BeZero())
+}
+
+func TestAccountRolloverKey(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := t.TempDir()
+	server := newFakeACMEServer(t)
+	keyPath := writeTestAccountKey(dir)
+	oldKey, err := os.ReadFile(keyPath)
+	Expect(err).NotTo(HaveOccurred())
+
+	_, err = runAccountCommand(dir, server, "rollover-key")
+	Expect(err).NotTo(HaveOccurred())
+	Expect(keyPath + ".new").NotTo(BeAnExistingFile())
+
+	newKey, err := os.ReadFile(keyPath)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(newKey).NotTo(Equal(oldKey))
+	info, err := os.Stat(keyPath)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(info.Mode().Perm()).To(Equal(os.FileMode(0o400)))
+
+	// the server only knows the account by the key now on disk
+	_, err = runAccountCommand(dir, server, "show")
+	Expect(err).NotTo(HaveOccurred())
+
+	// a failed rollover keeps the key the server still has
+	server.failKeyChange = true
+	_, err = runAccountCommand(dir, server, "rollover-key")
+	Expect(err).To(MatchError(ContainSubstring("could not roll over account key")))
+	Expect(keyPath + ".new").NotTo(BeAnExistingFile())
+	Expect(os.ReadFile(keyPath)).To(Equal(newKey))
+
+	_, err = runAccountCommand(dir, server, "show")
+	Expect(err).NotTo(HaveOccurred())
+}
+
+func TestAccountDeactivate(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := t.TempDir()
+	server := newFakeACMEServer(t)
+	writeTestAccountKey(dir)
+
+	_, err := runAccountCommand(dir, server, "deactivate")
+	Expect(err).To(MatchError(ContainSubstring("--yes")))
+	Expect(server.status).To(Equal(acme.StatusValid))
+
+	out, err := runAccountCommand(dir, server, "deactivate", "--yes")
+	Expect(err).NotTo(HaveOccurred())
+	Expect(out).To(ContainSubstring(acme.StatusDeactivated))
+	Expect(server.status).To(Equal(acme.StatusDeactivated))
+
+	// provision will not use it again, and show reports the saved copy
+	_, err = readAccount(filepath.Join(dir, ".config"), server.URL+"/directory")
+	Expect(err).To(MatchError(ErrAccountDeactivated))
+
+	server.Close()
+	out, err = runAccountCommand(dir, server, "show")
+	Expect(err).NotTo(HaveOccurred())
+	Expect(out).To(ContainSubstring(acme.StatusDeactivated))
+}
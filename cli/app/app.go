@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/alecthomas/kong"
 )
@@ -48,14 +49,43 @@ type StartOptions struct {
 
 type RunOptions struct {
 	Provision        *ProvisionCommand `cmd:"" help:"start the process of getting a new certificate"`
-	Stop             *StopCommand      `cmd:"" help:"stop a running provision command"`
+	Daemon           *DaemonCommand    `cmd:"" help:"keep running and provision whenever the certificate is due"`
+	Stop             *StopCommand      `cmd:"" help:"stop a running provision or daemon command"`
+	Account          *AccountCommand   `cmd:"" help:"inspect and manage the ACME account"`
+	Revoke           *RevokeCommand    `cmd:"" help:"revoke the installed certificate or a previous one"`
+	Status           *StatusCommand    `cmd:"" help:"show the installed certificate and when it will be renewed"`
+	Rollback         *RollbackCommand  `cmd:"" help:"list previously installed certificates or reinstall one of them"`
+	Prune            *PruneCommand     `cmd:"" help:"remove old certificates and backups according to the retention policy"`
+	Install          *InstallCommand   `cmd:"" help:"schedule provision to run with crond, using the current options"`
+	Uninstall        *UninstallCommand `cmd:"" help:"remove the scheduled provision runs"`
 	AccountEmail     string            `required:"true" env:"LE_ESXI_ACCOUNT_EMAIL" help:"The email addressed associated with your letsencrypt address"`
 	BaseDir          string            `default:"${basedir}" type:"existingdir" hidden:"true"`
-	TargetDirectory  string            `default:"/etc/vmware/ssl" type:"existingdir" help:"The directory where generated certs should be output"`
-	PluginsDir       string            `default:"${basedir}/plugins" env:"LE_ESXI_PLUGINS_DIR" type:"existingdir" help:"The directory where the plugin .so files are"`
+	Trigger          string            `default:"cli" env:"LE_ESXI_TRIGGER" hidden:"true" help:"What started this run, recorded in the install history"`
+	TargetDirectory  string            `default:"/etc/vmware/ssl" env:"LE_ESXI_TARGET_DIRECTORY" type:"existingdir" help:"The directory where generated certs should be output"`
+	PluginsDir       string            `default:"${basedir}/plugins" env:"LE_ESXI_PLUGINS_DIR" type:"existingdir" help:"The directory where the provider plugins (.so files or executables) are"`
 	Provider         string            `required:"true" env:"LE_ESXI_DNS_PROVIDER" help:"The name of the provider that should be loaded via the plugins"`
 	ACMEDirectoryURL string            `default:"https://acme-v02.api.letsencrypt.org/directory" env:"LE_ESXI_ACME_DIR_URL" help:"The ACME Directory URL for challenges"`
-	ProviderArgs     []string          `optional:"true" arg:"" env:"LE_ESXI_PROVIDER_ARGS" passthrough:"true" help:"Arguments that will be passed to the provider separated by commas"` // TODO fix when we know where args go
+	HostFQDN         bool              `default:"true" negatable:"" env:"LE_ESXI_HOST_FQDN" help:"Include the host FQDN (hostname -f) in the certificate"`
+	Domains          []string          `name:"domain" env:"LE_ESXI_DOMAINS" sep:"," help:"Additional DNS names to include in the certificate. Can be repeated"`
+	IPAddresses      []string          `name:"ip-address" env:"LE_ESXI_IP_ADDRESSES" sep:"," help:"IP addresses to include in the certificate. Not supported: CAs validate IP identifiers only with the http-01 and tls-alpn-01 challenges, and this tool solves dns-01"`
+	KeyType          string            `default:"ec256" enum:"${keytypes}" env:"LE_ESXI_KEY_TYPE" help:"The certificate key algorithm, one of ${keytypes}. Changing it generates a new key and reissues the certificate"`
+	AccountKeyType   string            `default:"ec256" enum:"${keytypes}" env:"LE_ESXI_ACCOUNT_KEY_TYPE" help:"The algorithm used when generating a new ACME account key, one of ${keytypes}"`
+	KeyRotation      string            `default:"always" env:"LE_ESXI_KEY_ROTATION" help:"When to generate a new certificate key: always, never, or a number N to rotate every N renewals"`
+	RenewBeforeDays  int               `env:"LE_ESXI_RENEW_BEFORE_DAYS" help:"When the CA offers no renewal info, renew once fewer than this many days remain. 0 disables the rule"`
+	RemainingPercent int               `name:"renew-remaining-percent" default:"33" env:"LE_ESXI_RENEW_REMAINING_PERCENT" help:"When the CA offers no renewal info, renew once less than this percentage of the certificate lifetime remains"`
+	RestartServices  bool              `default:"true" negatable:"" env:"LE_ESXI_RESTART_SERVICES" help:"Restart the management services after installing a certificate"`
+	RestartMethod    string            `default:"init" enum:"init,services.sh" env:"LE_ESXI_RESTART_METHOD" help:"Restart each of --service with its /etc/init.d script, or all management agents with services.sh"`
+	Services         []string          `name:"service" default:"hostd,rhttpproxy,vpxa" env:"LE_ESXI_SERVICES" sep:"," help:"The services to restart with the init method. Can be repeated"`
+	RestartTimeout   time.Duration     `default:"5m" env:"LE_ESXI_RESTART_TIMEOUT" help:"How long restarting the services may take"`
+	Verify           bool              `default:"true" negatable:"" env:"LE_ESXI_VERIFY" help:"Check the new certificate is served after installing it, and roll back to the previous one if it is not"`
+	VerifyTimeout    time.Duration     `default:"2m" env:"LE_ESXI_VERIFY_TIMEOUT" help:"How long to wait for the new certificate to be served"`
+	HealthAddress    string            `name:"health-check-address" default:"localhost:443" env:"LE_ESXI_HEALTH_CHECK_ADDRESS" help:"The address that must serve the new certificate"`
+	CAStorePrune     []string          `name:"castore-prune" enum:"expired,unused" env:"LE_ESXI_CASTORE_PRUNE" sep:"," help:"Remove CA certificates from castore.pem on install: expired ones, and unused ones this tool added for previous certificates. Can be repeated"`
+	KeepCertificates int               `default:"5" env:"LE_ESXI_KEEP_CERTIFICATES" help:"How many stored certificates to keep, including the active one. 0 keeps all of them"`
+	KeepBackups      int               `default:"3" env:"LE_ESXI_KEEP_BACKUPS" help:"How many backups of each file in the target directory to keep, besides the one of the certificate ESXi generated. 0 keeps all of them"`
+	AutoPrune        bool              `default:"true" negatable:"" env:"LE_ESXI_AUTO_PRUNE" help:"Apply the retention policy after installing a certificate"`
+	EABKeyID         string            `name:"eab-kid" env:"LE_ESXI_EAB_KID" help:"External Account Binding key ID, required by some CAs when registering a new account"`
+	EABHMACKey       string            `name:"eab-hmac-key" env:"LE_ESXI_EAB_HMAC_KEY" help:"Base64url encoded External Account Binding HMAC key, used with --eab-kid"`
 }
 
 type commandlineArgs struct {
@@ -104,27 +134,59 @@ func Run(ctx context.Context, opts *StartOptions) {
 		log.Fatal(err)
 	}
 
-	options := []kong.Option{
-		kong.Name(Name),
-		kong.Writers(opts.Stdout, opts.Stderr),
-		kong.Vars{
-			"basedir": filepath.Dir(filepath.Dir(exe)),
-			"version": fmt.Sprintf(versionFmt, opts.Version, opts.Build),
-		},
-		kong.BindTo(opts.LogWriter, (*io.WriteCloser)(nil)),
-		kong.BindTo(ctx, (*context.Context)(nil)),
-	}
-
 	var args commandlineArgs
-	k, err := kong.New(&args, options...)
+	k, err := newParser(ctx, opts, filepath.Dir(filepath.Dir(exe)), &args)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	kctx, err := k.Parse(opts.Args)
 	if err != nil {
-		log.Fatal(err)
+		// kong reports errors of the hooks as its own, keep their exit code
+		log.Print(err)
+		os.Exit(exitCode(err))
 	}
 
-	kctx.FatalIfErrorf(kctx.Run(args.RunOptions, args.ProviderArgs))
+	// a certificate swap cut short by a crash or power loss has to be repaired
+	// before any command looks at or changes the installed certificate
+	history := newHistoryJournal(args.RunOptions, kctx.Command())
+	err = recoverTLSFiles(filepath.Join(args.BaseDir, "run"), args.TargetDirectory, history)
+	if err == nil {
+		err = kctx.Run(args.RunOptions)
+	}
+
+	// not a failure, only a result for the caller
+	var status exitStatus
+	if errors.As(err, &status) {
+		kctx.Exit(status.ExitCode())
+		return
+	}
+
+	// kong would exit with the code of any error that has one, such as the
+	// exit status of a failed child process
+	if err != nil {
+		kctx.Errorf("%s", err)
+		kctx.Exit(exitCode(err))
+	}
+}
+
+// newParser returns the parser for the command line, which parses into args.
+// baseDir is the installation directory, the default for --base-dir.
+func newParser(ctx context.Context, opts *StartOptions, baseDir string, args *commandlineArgs) (*kong.Kong, error) {
+	return kong.New(args,
+		kong.Name(Name),
+		kong.Writers(opts.Stdout, opts.Stderr),
+		kong.Vars{
+			"basedir":  baseDir,
+			"version":  fmt.Sprintf(versionFmt, opts.Version, opts.Build),
+			"keytypes": keyTypeEnum,
+		},
+		kong.BindTo(opts.LogWriter, (*io.WriteCloser)(nil)),
+		kong.BindTo(ctx, (*context.Context)(nil)),
+		// commands read the global options in their AfterApply hooks, once the
+		// parsed values have been applied
+		kong.BindToProvider(func() (RunOptions, error) {
+			return args.RunOptions, nil
+		}),
+	)
 }
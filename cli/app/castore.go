@@ -0,0 +1,248 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	castorePruneExpired = "expired"
+	castorePruneUnused  = "unused"
+)
+
+// managedCAsFile in the config directory keeps the CAs added for certificates
+// that were pruned since, whose metadata no longer records them.
+const managedCAsFile = "managed-cas.json"
+
+// caStoreEntry is one PEM block of castore.pem. Blocks that are not
+// certificates, or do not parse, are kept as they are.
+type caStoreEntry struct {
+	block       *pem.Block
+	cert        *x509.Certificate
+	fingerprint string
+}
+
+// caStore is the trust bundle ESXi keeps in castore.pem. Certificates added
+// by others are always preserved; this tool only adds the CAs of its chains
+// and, if asked to, removes the ones it added that are no longer used.
+type caStore struct {
+	entries []caStoreEntry
+}
+
+func caFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// readCAStore parses the bundle at path. A missing bundle is empty, and a
+// certificate that appears more than once is only kept once.
+func readCAStore(path string) (*caStore, error) {
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &caStore{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	store := &caStore{}
+	for {
+		var block *pem.Block
+		if block, contents = pem.Decode(contents); block == nil {
+			break
+		}
+
+		entry := caStoreEntry{block: block}
+		if block.Type == "CERTIFICATE" {
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+				entry.cert, entry.fingerprint = cert, caFingerprint(cert)
+			}
+		}
+
+		if entry.fingerprint != "" && store.contains(entry.fingerprint) {
+			slog.Debug("dropping duplicate CA certificate", slog.String("path", path), slog.String("subject", entry.cert.Subject.String()))
+			continue
+		}
+		store.entries = append(store.entries, entry)
+	}
+
+	return store, nil
+}
+
+func (s *caStore) contains(fingerprint string) bool {
+	return slices.ContainsFunc(s.entries, func(e caStoreEntry) bool {
+		return e.fingerprint == fingerprint
+	})
+}
+
+// add appends the certificates of chain the store does not have yet and
+// returns the fingerprints of the ones it added.
+func (s *caStore) add(chain []*x509.Certificate) []string {
+	var added []string
+	for _, cert := range chain {
+		fingerprint := caFingerprint(cert)
+		if s.contains(fingerprint) {
+			continue
+		}
+
+		s.entries = append(s.entries, caStoreEntry{
+			block:       &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw},
+			cert:        cert,
+			fingerprint: fingerprint,
+		})
+		added = append(added, fingerprint)
+	}
+
+	return added
+}
+
+// prune removes expired certificates if expired is set, and the ones in
+// unused, which are those this tool added that the installed chain does not
+// need anymore.
+func (s *caStore) prune(expired bool, unused []string, now time.Time) {
+	s.entries = slices.DeleteFunc(s.entries, func(e caStoreEntry) bool {
+		switch {
+		case e.cert == nil:
+			return false
+		case expired && now.After(e.cert.NotAfter):
+			slog.Info("removing expired CA certificate from castore", slog.String("subject", e.cert.Subject.String()))
+			return true
+		case slices.Contains(unused, e.fingerprint):
+			slog.Info("removing unused CA certificate from castore", slog.String("subject", e.cert.Subject.String()))
+			return true
+		}
+
+		return false
+	})
+}
+
+func (s *caStore) bytes() []byte {
+	// never nil, an empty store is still written
+	buf := bytes.NewBuffer([]byte{})
+	for _, e := range s.entries {
+		pem.Encode(buf, e.block)
+	}
+
+	return buf.Bytes()
+}
+
+// updateCAStore returns the new contents of castore.pem with the CAs of
+// chain, and the fingerprints of the ones that were added.
+func (s *ProvisionCommand) updateCAStore(chain []*x509.Certificate) ([]byte, []string, error) {
+	store, err := readCAStore(filepath.Join(s.outputDir, castore))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	added := store.add(chain)
+
+	var unused []string
+	if slices.Contains(s.castorePrune, castorePruneUnused) {
+		managed, err := s.managedCAs()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, fingerprint := range managed {
+			if !slices.ContainsFunc(chain, func(c *x509.Certificate) bool { return caFingerprint(c) == fingerprint }) {
+				unused = append(unused, fingerprint)
+			}
+		}
+	}
+
+	store.prune(slices.Contains(s.castorePrune, castorePruneExpired), unused, time.Now())
+	return store.bytes(), added, nil
+}
+
+// managedCAs returns the fingerprints of every CA certificate this tool
+// added to castore.pem, as recorded in the certificate metadata and, for
+// pruned certificates, in the managed CAs file.
+func (s *ProvisionCommand) managedCAs() ([]string, error) {
+	managed, err := readManagedCAs(filepath.Join(s.configDir, managedCAsFile))
+	if err != nil {
+		return nil, err
+	}
+
+	metadataFiles, err := filepath.Glob(filepath.Join(s.certsDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, jsonPath := range metadataFiles {
+		meta, err := readCertMetadata(jsonPath)
+		if err != nil {
+			slog.Warn("skipping unreadable certificate metadata", slog.String("path", jsonPath), slog.Any("error", err))
+			continue
+		}
+
+		managed = appendMissing(managed, meta.AddedCAs...)
+	}
+
+	return managed, nil
+}
+
+func readManagedCAs(path string) ([]string, error) {
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var managed []string
+	if err = json.Unmarshal(contents, &managed); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+
+	return managed, nil
+}
+
+// recordManagedCAs adds fingerprints to the managed CAs file at path.
+func recordManagedCAs(path string, fingerprints []string) error {
+	managed, err := readManagedCAs(path)
+	if err != nil {
+		return err
+	}
+
+	updated := appendMissing(managed, fingerprints...)
+	if len(updated) == len(managed) {
+		return nil
+	}
+
+	contents, err := json.Marshal(updated)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, contents, 0o600)
+}
+
+// appendMissing appends the fingerprints s does not contain yet.
+func appendMissing(s []string, fingerprints ...string) []string {
+	for _, fingerprint := range fingerprints {
+		if !slices.Contains(s, fingerprint) {
+			s = append(s, fingerprint)
+		}
+	}
+
+	return s
+}
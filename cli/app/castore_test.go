@@ -0,0 +1,116 @@
+package app
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func testCA(dir, name string, notAfter time.Time) *x509.Certificate {
+	meta := writeTestCertificate(dir, name, notAfter.Add(-365*24*time.Hour), notAfter)
+	cert, err := readLeafCertificate(meta.PEMPath)
+	Expect(err).NotTo(HaveOccurred())
+	return cert
+}
+
+func encodeCAs(certs ...*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		Expect(pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})).To(Succeed())
+	}
+	return buf.Bytes()
+}
+
+func TestUpdateCAStore(t *testing.T) {
+	RegisterTestingT(t)
+
+	caDir, outputDir, certsDir := t.TempDir(), t.TempDir(), t.TempDir()
+	now := time.Now()
+	vmware := testCA(caDir, "vmware", now.Add(365*24*time.Hour))
+	expired := testCA(caDir, "expired", now.Add(-time.Hour))
+	oldIssuer := testCA(caDir, "old-issuer", now.Add(365*24*time.Hour))
+	issuer := testCA(caDir, "issuer", now.Add(365*24*time.Hour))
+
+	// earlier versions appended the chain on every renewal
+	existing := encodeCAs(vmware, expired, oldIssuer, oldIssuer, oldIssuer)
+	Expect(os.WriteFile(filepath.Join(outputDir, castore), existing, 0o644)).To(Succeed())
+	Expect(writeCertMetadata(filepath.Join(certsDir, "aa11.json"), acmeCertWithPath{PEMPath: filepath.Join(certsDir, "aa11.pem"), AddedCAs: []string{caFingerprint(oldIssuer)}})).To(Succeed())
+
+	s := &ProvisionCommand{outputDir: outputDir, certsDir: certsDir}
+	contents, added, err := s.updateCAStore([]*x509.Certificate{issuer, vmware})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(added).To(Equal([]string{caFingerprint(issuer)}))
+	Expect(contents).To(Equal(encodeCAs(vmware, expired, oldIssuer, issuer)))
+
+	// nothing new, nothing added
+	Expect(os.WriteFile(filepath.Join(outputDir, castore), contents, 0o644)).To(Succeed())
+	contents, added, err = s.updateCAStore([]*x509.Certificate{issuer})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(added).To(BeEmpty())
+	Expect(contents).To(Equal(encodeCAs(vmware, expired, oldIssuer, issuer)))
+
+	s.castorePrune = []string{castorePruneExpired}
+	contents, _, err = s.updateCAStore([]*x509.Certificate{issuer})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(contents).To(Equal(encodeCAs(vmware, oldIssuer, issuer)))
+
+	// only the CAs this tool added can be unused, the one from VMware stays
+	s.castorePrune = []string{castorePruneExpired, castorePruneUnused}
+	contents, _, err = s.updateCAStore([]*x509.Certificate{issuer})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(contents).To(Equal(encodeCAs(vmware, issuer)))
+}
+
+func TestReadCAStoreKeepsOtherBlocks(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := t.TempDir()
+	ca := testCA(dir, "ca", time.Now().Add(time.Hour))
+	crl := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: []byte("not parsed")})
+	path := filepath.Join(dir, castore)
+	Expect(os.WriteFile(path, append(crl, encodeCAs(ca, ca)...), 0o644)).To(Succeed())
+
+	store, err := readCAStore(path)
+	Expect(err).NotTo(HaveOccurred())
+	store.prune(true, []string{caFingerprint(ca)}, time.Now())
+	Expect(store.bytes()).To(Equal(crl))
+
+	store, err = readCAStore(filepath.Join(dir, "missing.pem"))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(store.bytes()).To(BeEmpty())
+}
+
+func TestPrunedCertificateCAsStayManaged(t *testing.T) {
+	RegisterTestingT(t)
+
+	baseDir, caDir, outputDir := t.TempDir(), t.TempDir(), t.TempDir()
+	certsDir := filepath.Join(baseDir, "certs")
+	Expect(os.MkdirAll(certsDir, 0o755)).To(Succeed())
+
+	now := time.Now()
+	vmware := testCA(caDir, "vmware", now.Add(365*24*time.Hour))
+	oldIssuer := testCA(caDir, "old-issuer", now.Add(365*24*time.Hour))
+	issuer := testCA(caDir, "issuer", now.Add(365*24*time.Hour))
+	Expect(os.WriteFile(filepath.Join(outputDir, castore), encodeCAs(vmware, oldIssuer), 0o644)).To(Succeed())
+
+	// the old issuer was added for a certificate that is pruned
+	old := writeTestCertificate(certsDir, "aa11", now.Add(-60*24*time.Hour), now.Add(30*24*time.Hour))
+	old.AddedCAs = []string{caFingerprint(oldIssuer)}
+	Expect(writeCertMetadata(filepath.Join(certsDir, "aa11.json"), old)).To(Succeed())
+	writeTestCertificate(certsDir, "bb22", now.Add(-time.Hour), now.Add(90*24*time.Hour))
+
+	_, err := newPruner(RunOptions{BaseDir: baseDir, TargetDirectory: outputDir, KeepCertificates: 1}).prune(false)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(filepath.Join(certsDir, "aa11.json")).NotTo(BeAnExistingFile())
+
+	s := &ProvisionCommand{outputDir: outputDir, certsDir: certsDir, configDir: filepath.Join(baseDir, ".config"), castorePrune: []string{castorePruneUnused}}
+	contents, _, err := s.updateCAStore([]*x509.Certificate{issuer})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(contents).To(Equal(encodeCAs(vmware, issuer)))
+}
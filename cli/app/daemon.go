@@ -0,0 +1,122 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+type DaemonCommand struct {
+	ProvisionCommand `embed:""`
+
+	Interval     time.Duration `default:"12h" env:"LE_ESXI_DAEMON_INTERVAL" help:"How often to check whether the certificate is due for renewal"`
+	Jitter       time.Duration `default:"1h" env:"LE_ESXI_DAEMON_JITTER" help:"Up to how much random time to add to each interval, so hosts do not all check at once"`
+	RetryBackoff time.Duration `default:"5m" env:"LE_ESXI_DAEMON_RETRY_BACKOFF" help:"How long to wait after a failed renewal. It doubles with every further failure"`
+	MaxBackoff   time.Duration `default:"6h" env:"LE_ESXI_DAEMON_MAX_BACKOFF" help:"The longest to wait after failed renewals"`
+}
+
+func (*DaemonCommand) Help() string {
+	return `Stays running and provisions whenever the certificate is due, as an alternative to
+scheduling provision with install. It holds the same run lock as provision, so stop
+stops it, and provision cannot run next to it. SIGTERM and SIGINT stop it cleanly.`
+}
+
+// AfterApply hides the one of the embedded ProvisionCommand, which kong calls
+// by itself, so it runs once.
+func (d *DaemonCommand) AfterApply() error {
+	return nil
+}
+
+func (d *DaemonCommand) Run(ctx context.Context) error {
+	lock, err := acquireRunLock(ctx, d.runDir, "daemon", d.Wait)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	slog.Info("daemon started", slog.Duration("interval", d.Interval))
+	failures := 0
+	for {
+		err = d.reportRun(func(report *provisionReport) error {
+			return d.provision(ctx, report)
+		})
+
+		if ctx.Err() != nil {
+			slog.Info("daemon stopped")
+			return nil
+		}
+
+		var wait time.Duration
+		switch exitCode(err) {
+		case ExitRenewed, ExitNotDue:
+			failures = 0
+			wait = time.Until(d.nextCheck(time.Now()))
+		default:
+			failures++
+			wait = d.backoff(failures)
+			slog.Error("renewal failed, retrying", slog.Any("error", err), slog.Int("failures", failures), slog.Duration("retry-in", wait))
+		}
+
+		slog.Debug("waiting for the next check", slog.Duration("wait", wait))
+		select {
+		case <-ctx.Done():
+			slog.Info("daemon stopped")
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// nextCheck returns when to check the certificate again: after the interval,
+// or earlier if the renewal info asks to be fetched again sooner, or the
+// certificate becomes due before then.
+func (d *DaemonCommand) nextCheck(now time.Time) time.Time {
+	next := now.Add(d.Interval)
+	if d.Jitter > 0 {
+		next = next.Add(rand.N(d.Jitter))
+	}
+
+	current, err := readActiveCertMetadata(d.outputDir)
+	if err != nil || current == nil {
+		return next
+	}
+
+	earlier := func(t time.Time) {
+		if t.After(now) && t.Before(next) {
+			next = t
+		}
+	}
+
+	if info := current.RenewalInfo; info != nil && info.HasWindow() {
+		if info.RetryAfter != nil {
+			earlier(*info.RetryAfter)
+		}
+		earlier(ariRenewalTime(*info))
+	} else if leaf, err := readLeafCertificate(current.PEMPath); err == nil {
+		earlier(fallbackRenewalTime(leaf, d.renewBeforeDays, d.renewPercent))
+	}
+
+	return next
+}
+
+// backoff returns how long to wait after the given number of consecutive
+// failures: the retry backoff doubled for each failure after the first, up to
+// the maximum, less up to a tenth at random.
+func (d *DaemonCommand) backoff(failures int) time.Duration {
+	wait := d.RetryBackoff
+	for range failures - 1 {
+		if wait >= d.MaxBackoff/2 {
+			wait = d.MaxBackoff
+			break
+		}
+		wait *= 2
+	}
+	wait = min(wait, d.MaxBackoff)
+
+	if spread := wait / 10; spread > 0 {
+		wait -= rand.N(spread)
+	}
+
+	return wait
+}
@@ -0,0 +1,82 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestDaemonNextCheck(t *testing.T) {
+	RegisterTestingT(t)
+
+	certsDir, outputDir := t.TempDir(), t.TempDir()
+	d := &DaemonCommand{Interval: 12 * time.Hour, Jitter: time.Hour}
+	d.outputDir = outputDir
+	d.renewPercent = 33
+
+	// nothing installed yet
+	now := time.Now()
+	Expect(d.nextCheck(now)).To(BeTemporally("~", now.Add(12*time.Hour+30*time.Minute), 30*time.Minute))
+
+	// due in an hour by its remaining lifetime
+	issued := now.Add(-60*24*time.Hour + time.Hour)
+	meta := writeTestCertificate(certsDir, "aa11", issued, issued.Add(90*24*time.Hour))
+	Expect(os.Symlink(meta.PEMPath, filepath.Join(outputDir, certFile))).To(Succeed())
+	leaf, err := readLeafCertificate(meta.PEMPath)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(d.nextCheck(now)).To(BeTemporally("==", fallbackRenewalTime(leaf, 0, 33)))
+
+	// renewal info replaces the lifetime, and asks to be fetched again first
+	start := now.Add(24 * time.Hour)
+	info := renewalWindow(start, start.Add(48*time.Hour), start.Add(time.Hour))
+	retryAfter := now.Add(6 * time.Hour)
+	info.RetryAfter = &retryAfter
+	meta.RenewalInfo = &info
+	Expect(writeCertMetadata(filepath.Join(certsDir, "aa11.json"), meta)).To(Succeed())
+	Expect(d.nextCheck(now)).To(BeTemporally("==", retryAfter))
+
+	// a selected time before then
+	info.SelectedTime = now.Add(2 * time.Hour)
+	Expect(writeCertMetadata(filepath.Join(certsDir, "aa11.json"), meta)).To(Succeed())
+	Expect(d.nextCheck(now)).To(BeTemporally("==", info.SelectedTime))
+
+	// times already past leave the interval
+	info.SelectedTime = now.Add(-time.Hour)
+	info.RetryAfter = nil
+	Expect(writeCertMetadata(filepath.Join(certsDir, "aa11.json"), meta)).To(Succeed())
+	Expect(d.nextCheck(now)).To(BeTemporally(">=", now.Add(12*time.Hour)))
+}
+
+func TestDaemonBackoff(t *testing.T) {
+	RegisterTestingT(t)
+
+	d := &DaemonCommand{RetryBackoff: 10 * time.Minute, MaxBackoff: time.Hour}
+	Expect(d.backoff(1)).To(BeNumerically("~", 10*time.Minute-30*time.Second, 30*time.Second))
+	Expect(d.backoff(2)).To(BeNumerically("~", 20*time.Minute-time.Minute, time.Minute))
+	Expect(d.backoff(3)).To(BeNumerically("~", 40*time.Minute-2*time.Minute, 2*time.Minute))
+	Expect(d.backoff(4)).To(BeNumerically("~", 57*time.Minute, 3*time.Minute))
+	Expect(d.backoff(1000)).To(BeNumerically("<=", time.Hour))
+}
+
+func TestDaemonCommandLine(t *testing.T) {
+	RegisterTestingT(t)
+
+	for _, command := range []string{"provision", "daemon"} {
+		_, parsed, err := parseTestCommandLine(t.TempDir(), "--domain", "vcenter.example.com", command)
+		Expect(err).NotTo(HaveOccurred())
+
+		s := parsed.Provision
+		if command == "daemon" {
+			s = &parsed.Daemon.ProvisionCommand
+		}
+
+		// set up once: the identifiers once each, and the account key that
+		// was just generated still needs an account
+		Expect(s.certificateSANs()).To(Equal([]string{"esxi01.example.com", "vcenter.example.com"}), command)
+		Expect(s.createAccount).To(BeTrue(), command)
+		Expect(s.history.trigger.Command).To(Equal(command))
+	}
+}
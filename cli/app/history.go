@@ -0,0 +1,156 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+const (
+	historyFile = "history.jsonl"
+
+	historyActionInstall  = "install"
+	historyActionRollback = "rollback"
+	historyActionRecover  = "recover"
+
+	historyOutcomeSuccess    = "success"
+	historyOutcomeFailed     = "failed"
+	historyOutcomeRolledBack = "rolled-back"
+)
+
+var errRolledBack = errors.New("rolled back")
+
+// historyEntry is one line of the install history. The journal is an audit
+// trail, so fields may be added but never renamed or removed.
+type historyEntry struct {
+	Time        time.Time       `json:"time"`
+	Action      string          `json:"action"`
+	Outcome     string          `json:"outcome"`
+	Error       string          `json:"error,omitempty"`
+	OldHash     string          `json:"oldHash,omitempty"`
+	NewHash     string          `json:"newHash,omitempty"`
+	KeyPath     string          `json:"keyPath,omitempty"`
+	Backups     []tlsFileBackup `json:"backups,omitempty"`
+	CAURL       string          `json:"caURL,omitempty"`
+	TriggeredBy historyTrigger  `json:"triggeredBy"`
+}
+
+type historyTrigger struct {
+	Command string `json:"command"`
+	Trigger string `json:"trigger"`
+	User    string `json:"user,omitempty"`
+	PID     int    `json:"pid"`
+}
+
+// historyJournal appends to the install history in BaseDir.
+type historyJournal struct {
+	path    string
+	trigger historyTrigger
+}
+
+func newHistoryJournal(opts RunOptions, command string) historyJournal {
+	trigger := historyTrigger{Command: command, Trigger: opts.Trigger, PID: os.Getpid()}
+	if u, err := user.Current(); err == nil {
+		trigger.User = u.Username
+	} else {
+		trigger.User = os.Getenv("USER")
+	}
+
+	return historyJournal{path: filepath.Join(opts.BaseDir, historyFile), trigger: trigger}
+}
+
+// record completes entry with the outcome of err and appends it. Failing to
+// write the journal must not fail the change it describes, so errors are
+// only logged.
+func (h historyJournal) record(entry historyEntry, err error) {
+	entry.Time = time.Now().UTC()
+	entry.TriggeredBy = h.trigger
+	switch {
+	case err == nil:
+		entry.Outcome = historyOutcomeSuccess
+	case errors.Is(err, errRolledBack):
+		entry.Outcome = historyOutcomeRolledBack
+		entry.Error = err.Error()
+	default:
+		entry.Outcome = historyOutcomeFailed
+		entry.Error = err.Error()
+	}
+
+	if werr := h.append(entry); werr != nil {
+		slog.Warn("could not write install history", slog.String("path", h.path), slog.Any("error", werr))
+	}
+}
+
+func (h historyJournal) append(entry historyEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	fp, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	// one write per entry, so concurrent writers cannot interleave lines
+	if _, err = fp.Write(append(line, '\n')); err == nil {
+		err = fp.Sync()
+	}
+
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// readHistory returns the journal entries oldest first. A missing journal is
+// empty, and lines that cannot be parsed are skipped.
+func readHistory(path string) ([]historyEntry, error) {
+	fp, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var entries []historyEntry
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry historyEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			slog.Warn("skipping unreadable install history entry", slog.String("path", path), slog.Int("line", line), slog.Any("error", err))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return entries, fmt.Errorf("could not read install history %s: %w", path, err)
+	}
+
+	return entries, nil
+}
+
+// lastInstalled returns when hash was last successfully installed or rolled
+// back to, if the journal knows.
+func lastInstalled(entries []historyEntry, hash string) *time.Time {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Outcome == historyOutcomeSuccess && entries[i].NewHash == hash {
+			return &entries[i].Time
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestHistoryJournal(t *testing.T) {
+	RegisterTestingT(t)
+
+	baseDir := t.TempDir()
+	h := newHistoryJournal(RunOptions{BaseDir: baseDir, Trigger: "cron"}, "provision")
+
+	entries, err := readHistory(h.path)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(entries).To(BeEmpty())
+
+	h.record(historyEntry{Action: historyActionInstall, NewHash: "aa11"}, nil)
+
+	// a line torn by a crash must not hide the rest of the journal
+	fp, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND, 0)
+	Expect(err).NotTo(HaveOccurred())
+	_, err = fp.WriteString("{\"time\":\n")
+	Expect(err).NotTo(HaveOccurred())
+	Expect(fp.Close()).To(Succeed())
+
+	h.record(historyEntry{Action: historyActionInstall, OldHash: "aa11", NewHash: "bb22"}, errors.New("order failed"))
+	h.record(historyEntry{Action: historyActionInstall, OldHash: "aa11", NewHash: "cc33"}, fmt.Errorf("%w: not served", errRolledBack))
+
+	entries, err = readHistory(h.path)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(entries).To(HaveLen(3))
+	Expect(entries[0].Outcome).To(Equal(historyOutcomeSuccess))
+	Expect(entries[0].TriggeredBy.Command).To(Equal("provision"))
+	Expect(entries[0].TriggeredBy.Trigger).To(Equal("cron"))
+	Expect(entries[0].TriggeredBy.PID).To(Equal(os.Getpid()))
+	Expect(entries[1].Outcome).To(Equal(historyOutcomeFailed))
+	Expect(entries[1].Error).To(Equal("order failed"))
+	Expect(entries[2].Outcome).To(Equal(historyOutcomeRolledBack))
+
+	Expect(*lastInstalled(entries, "aa11")).To(BeTemporally("==", entries[0].Time))
+	Expect(lastInstalled(entries, "cc33")).To(BeNil())
+}
+
+func TestRollbackFindsOriginalInHistory(t *testing.T) {
+	RegisterTestingT(t)
+
+	baseDir, outputDir, backupDir := t.TempDir(), t.TempDir(), t.TempDir()
+	now := time.Now()
+
+	// backups that do not follow the naming the fallback looks for
+	original := writeTestCertificate(backupDir, "vmware", now, now.Add(time.Hour))
+
+	c := &RollbackCommand{}
+	Expect(c.AfterApply(RunOptions{BaseDir: baseDir, TargetDirectory: outputDir})).To(Succeed())
+
+	_, ok := c.originalCandidate()
+	Expect(ok).To(BeFalse())
+
+	c.history.record(historyEntry{
+		Action:  historyActionInstall,
+		NewHash: "aa11",
+		Backups: []tlsFileBackup{
+			{Path: filepath.Join(outputDir, privateKeyFile), BackupPath: original.KeyPath},
+			{Path: filepath.Join(outputDir, certFile), BackupPath: original.PEMPath},
+		},
+	}, nil)
+
+	candidate, ok := c.originalCandidate()
+	Expect(ok).To(BeTrue())
+	Expect(candidate.CertPath).To(Equal(original.PEMPath))
+	Expect(candidate.KeyPath).To(Equal(original.KeyPath))
+}
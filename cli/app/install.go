@@ -2,68 +2,542 @@ package app
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kong"
+)
+
+const (
+	scheduleEnvFile = "schedule.env"
+
+	managedBlockBegin = "# BEGIN " + Name + ", managed by its install command"
+	managedBlockEnd   = "# END " + Name
 )
 
-const crontabFilePath = "/var/spool/cron/crontabs/root"
+// schedulePaths are the system files install manages. They are only set to
+// something else for testing.
+type schedulePaths struct {
+	CrontabFile string `default:"/var/spool/cron/crontabs/root" env:"LE_ESXI_CRONTAB_FILE" type:"path" hidden:"true" help:"The crontab crond runs provision from"`
+	BootScript  string `default:"/etc/rc.local.d/local.sh" env:"LE_ESXI_BOOT_SCRIPT" type:"path" hidden:"true" help:"The script ESXi runs at boot, which restores the crontab entry"`
+}
+
+type InstallCommand struct {
+	schedulePaths `embed:""`
 
-type InstallCommand struct{}
+	Schedule           string   `default:"0 0 * * *" env:"LE_ESXI_SCHEDULE" help:"When crond should run provision, as the five fields of a crontab line. Provision only renews once the certificate is due"`
+	Check              bool     `help:"Only report whether the crontab entry and the boot hook are installed and up to date, and fail if they are not"`
+	ProviderArgs       []string `optional:"true" arg:"" passthrough:"all" help:"Arguments that will be passed to the provider by the scheduled runs"`
+	JoinedProviderArgs []string `name:"provider-args" env:"LE_ESXI_PROVIDER_ARGS" hidden:"true" help:"Arguments that will be passed to the provider by the scheduled runs if none are given, separated by commas. A comma in an argument is escaped with a backslash"`
+
+	opts         RunOptions
+	exePath      string
+	envPath      string
+	backupScript string
+	crond        crondService
+}
+
+type UninstallCommand struct {
+	schedulePaths `embed:""`
+
+	exePath      string
+	envPath      string
+	backupScript string
+	crond        crondService
+}
+
+// crondService restarts the busybox crond ESXi runs, which only reads the
+// crontab when it starts.
+type crondService struct {
+	pidFile string
+	command []string
+	timeout time.Duration
+}
+
+func newCrondService() crondService {
+	return crondService{
+		pidFile: "/var/run/crond.pid",
+		command: []string{"/usr/lib/vmware/busybox/bin/busybox", "crond"},
+		timeout: 10 * time.Second,
+	}
+}
+
+func (*InstallCommand) Help() string {
+	return `ESXi recreates the crontab from its boot image on every boot, so install also adds a
+block to the boot script that puts the entry back. The options install runs with are
+saved for the scheduled runs, so run it again after changing them.
+
+With --check, the exit code is 0 if everything is installed and up to date, 1 otherwise.`
+}
+
+func (i *InstallCommand) AfterApply(opts RunOptions) error {
+	fields := strings.Fields(i.Schedule)
+	if len(fields) != 5 {
+		return fmt.Errorf("--schedule must have the five fields of a crontab line, got %q", i.Schedule)
+	}
+	i.Schedule = strings.Join(fields, " ")
+	if len(i.ProviderArgs) == 0 {
+		i.ProviderArgs = i.JoinedProviderArgs
+	}
 
-func (i *InstallCommand) Run() error {
 	exePath, err := os.Executable()
 	if err != nil {
 		return err
 	}
 
-	pid := i.findCrondPID()
-	proc, _ := os.FindProcess(pid)
-	proc.Signal(syscall.SIGHUP)
+	i.opts = opts
+	i.exePath = exePath
+	i.envPath = filepath.Join(opts.BaseDir, ".config", scheduleEnvFile)
+	i.backupScript = "/sbin/auto-backup.sh"
+	i.crond = newCrondService()
+	return nil
+}
+
+func (i *InstallCommand) Run(kctx *kong.Context) error {
+	if i.Check {
+		return i.check(kctx.Stdout)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(i.envPath), 0o700); err != nil {
+		return fmt.Errorf("could not ensure config directory exists: %w", err)
+	}
 
-	stat, err := os.Stat(crontabFilePath)
+	// the environment file holds the account and EAB settings, which are
+	// better kept out of the crontab
+	if _, err := writeIfChanged(i.envPath, i.environment(), 0o600); err != nil {
+		return fmt.Errorf("could not write %s: %w", i.envPath, err)
+	}
+
+	bootChanged, err := updateManagedBlock(i.BootScript, i.bootHook(), nil, 0o755)
 	if err != nil {
+		return fmt.Errorf("could not install the boot hook: %w", err)
+	}
+
+	if bootChanged {
+		slog.Info("installed boot hook", slog.String("boot-script", i.BootScript))
+		persistConfiguration(i.backupScript)
+	}
+
+	changed, err := updateManagedBlock(i.CrontabFile, i.cronEntry(), legacyCronLine(i.exePath), 0o600)
+	if err != nil {
+		return fmt.Errorf("could not update the crontab: %w", err)
+	}
+
+	if !changed {
+		slog.Info("scheduled renewal is already installed", slog.String("crontab", i.CrontabFile))
+		return nil
+	}
+
+	slog.Info("installed scheduled renewal", slog.String("crontab", i.CrontabFile), slog.String("schedule", i.Schedule))
+	return i.crond.restart()
+}
+
+// check reports whether the crontab entry and the boot hook match what
+// install would write.
+func (i *InstallCommand) check(w io.Writer) error {
+	installed := true
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, f := range []struct {
+		name, path string
+		want       []string
+	}{
+		{"crontab entry", i.CrontabFile, i.cronEntry()},
+		{"boot hook", i.BootScript, i.bootHook()},
+	} {
+		block, err := readManagedBlock(f.path)
+		if err != nil {
+			return err
+		}
+
+		state := "installed"
+		switch {
+		case block == nil:
+			state, installed = "missing", false
+		case !slices.Equal(block, f.want):
+			state, installed = "outdated, run install again", false
+		}
+		fmt.Fprintf(tw, "%s:\t%s\t(%s)\n", f.name, state, f.path)
+	}
+
+	if err := tw.Flush(); err != nil {
 		return err
 	}
 
-	crontabFp, err := os.OpenFile(crontabFilePath, os.O_APPEND, stat.Mode()&os.ModePerm)
+	if !installed {
+		return errors.New("the schedule is not installed as configured, run install again")
+	}
+
+	return nil
+}
+
+// environment returns the contents of the file the scheduled runs read their
+// options from.
+func (i *InstallCommand) environment() []byte {
+	env := scheduleEnvironment(i.opts, i.ProviderArgs)
+	env = append(env, "LE_ESXI_SCHEDULE="+shellQuote(i.Schedule))
+	return []byte(strings.Join(env, "\n") + "\n")
+}
+
+// cronEntry returns the lines of the block in the crontab.
+func (i *InstallCommand) cronEntry() []string {
+	line := fmt.Sprintf("%s set -a; . %s; exec %s provision", i.Schedule, shellQuote(i.envPath), shellQuote(i.exePath))
+
+	// crond turns % into a newline
+	return []string{strings.ReplaceAll(line, "%", `\%`)}
+}
+
+// bootHook returns the lines of the block in the boot script, which adds the
+// crontab block back after ESXi recreated the crontab, and restarts crond so
+// it reads it.
+func (i *InstallCommand) bootHook() []string {
+	entry := append([]string{managedBlockBegin}, i.cronEntry()...)
+	entry = append(entry, managedBlockEnd)
+
+	quoted := make([]string, 0, len(entry))
+	for _, line := range entry {
+		quoted = append(quoted, shellQuote(line))
+	}
+
+	command := make([]string, 0, len(i.crond.command))
+	for _, arg := range i.crond.command {
+		command = append(command, shellQuote(arg))
+	}
+
+	return []string{
+		"if ! grep -qxF " + shellQuote(managedBlockBegin) + " " + shellQuote(i.CrontabFile) + " 2>/dev/null; then",
+		"  printf '%s\\n' " + strings.Join(quoted, " ") + " >> " + shellQuote(i.CrontabFile),
+		"  kill $(cat " + shellQuote(i.crond.pidFile) + ") 2>/dev/null && sleep 1",
+		"  " + strings.Join(command, " "),
+		"fi",
+	}
+}
+
+func (u *UninstallCommand) AfterApply(opts RunOptions) error {
+	exePath, err := os.Executable()
 	if err != nil {
 		return err
 	}
 
-	fmt.Fprintf(crontabFp, "\n0\t0\t*\t*\t0\t%s provision", exePath)
-	crontabFp.Close()
+	u.exePath = exePath
+	u.envPath = filepath.Join(opts.BaseDir, ".config", scheduleEnvFile)
+	u.backupScript = "/sbin/auto-backup.sh"
+	u.crond = newCrondService()
+	return nil
+}
+
+func (u *UninstallCommand) Run() error {
+	bootChanged, err := updateManagedBlock(u.BootScript, nil, nil, 0o755)
+	if err != nil {
+		return fmt.Errorf("could not remove the boot hook: %w", err)
+	}
+
+	if bootChanged {
+		slog.Info("removed boot hook", slog.String("boot-script", u.BootScript))
+		persistConfiguration(u.backupScript)
+	}
+
+	changed, err := updateManagedBlock(u.CrontabFile, nil, legacyCronLine(u.exePath), 0o600)
+	if err != nil {
+		return fmt.Errorf("could not update the crontab: %w", err)
+	}
+
+	if err = os.Remove(u.envPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if !changed {
+		slog.Info("no scheduled renewal is installed", slog.String("crontab", u.CrontabFile))
+		return nil
+	}
+
+	slog.Info("removed scheduled renewal", slog.String("crontab", u.CrontabFile))
+	return u.crond.restart()
+}
+
+// persistConfiguration saves the changed boot script to the boot bank right
+// away, instead of whenever ESXi next does so on its own.
+func persistConfiguration(backupScript string) {
+	if backupScript == "" {
+		return
+	}
+
+	if _, err := os.Stat(backupScript); err != nil {
+		return
+	}
+
+	if output, err := exec.Command(backupScript).CombinedOutput(); err != nil {
+		slog.Warn("could not persist the configuration, ESXi will do so later", slog.String("command", backupScript),
+			slog.Any("error", err), slog.String("output", strings.TrimSpace(string(output))))
+	}
+}
+
+// scheduleEnvironment returns the global options as the environment variables
+// they can be set with, so scheduled runs use the configuration install was
+// run with. Options that are not set are left out, so their defaults apply.
+func scheduleEnvironment(opts RunOptions, providerArgs []string) []string {
+	var env []string
+	set := func(name, value string) {
+		env = append(env, name+"="+shellQuote(value))
+	}
+
+	v := reflect.ValueOf(opts)
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("env"), ",")
+		if name == "" || name == "LE_ESXI_TRIGGER" {
+			continue
+		}
+
+		switch value := v.Field(i).Interface().(type) {
+		case string:
+			if value != "" {
+				set(name, value)
+			}
+		case []string:
+			if len(value) > 0 {
+				set(name, strings.Join(value, ","))
+			}
+		case bool:
+			set(name, strconv.FormatBool(value))
+		case int:
+			set(name, strconv.Itoa(value))
+		case time.Duration:
+			set(name, value.String())
+		}
+	}
+
+	if len(providerArgs) > 0 {
+		// read back by the provider-args flag, which kong splits
+		set("LE_ESXI_PROVIDER_ARGS", kong.JoinEscaped(providerArgs, ','))
+	}
+	set("LE_ESXI_TRIGGER", "cron")
+
+	return env
+}
+
+// legacyCronLine matches the line earlier versions appended to the crontab on
+// every install.
+func legacyCronLine(exePath string) func(string) bool {
+	return func(line string) bool {
+		return slices.Equal(strings.Fields(line), []string{"0", "0", "*", "*", "0", exePath, "provision"})
+	}
+}
+
+// readManagedBlock returns the lines of the block this tool manages in the
+// file at path, or nil if there is none.
+func readManagedBlock(path string) ([]string, error) {
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
 
-	// Re-run crond and detach it from this process
-	cmd := exec.Command("crond")
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setsid: true,
+	var block []string
+	inBlock := false
+	scanner := bufio.NewScanner(strings.NewReader(string(contents)))
+	for scanner.Scan() {
+		switch line := scanner.Text(); {
+		case line == managedBlockBegin:
+			inBlock, block = true, []string{}
+		case line == managedBlockEnd:
+			return block, nil
+		case inBlock:
+			block = append(block, line)
+		}
 	}
 
-	return cmd.Start()
+	return nil, nil
 }
 
-func (*InstallCommand) findCrondPID() int {
+// updateManagedBlock replaces the block this tool manages in the file at path
+// with lines, or removes it if there are none, and reports whether the file
+// changed. Lines drop matches are removed as well. The block goes before the
+// exit at the end of a boot script, or else at the end of the file.
+func updateManagedBlock(path string, lines []string, drop func(string) bool, perm os.FileMode) (bool, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+
+	if contents == nil {
+		if len(lines) == 0 {
+			return false, nil
+		}
+
+		if perm&0o111 != 0 {
+			contents = []byte("#!/bin/sh\nexit 0\n")
+		}
+	}
+
+	var kept []string
+	inBlock := false
+	scanner := bufio.NewScanner(strings.NewReader(string(contents)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == managedBlockBegin:
+			inBlock = true
+		case line == managedBlockEnd:
+			inBlock = false
+		case inBlock:
+		case drop != nil && drop(line):
+			slog.Info("removing line added by an earlier version", slog.String("path", path), slog.String("line", line))
+		default:
+			kept = append(kept, line)
+		}
+	}
+
+	// blank lines the earlier versions left where the block goes
+	for len(kept) > 0 && strings.TrimSpace(kept[len(kept)-1]) == "" {
+		kept = kept[:len(kept)-1]
+	}
+
+	var exit []string
+	if len(kept) > 0 && strings.TrimSpace(kept[len(kept)-1]) == "exit 0" {
+		kept, exit = kept[:len(kept)-1], []string{kept[len(kept)-1]}
+	}
+
+	if len(lines) > 0 {
+		kept = append(kept, managedBlockBegin)
+		kept = append(kept, lines...)
+		kept = append(kept, managedBlockEnd)
+	}
+	kept = append(kept, exit...)
+
+	updated := ""
+	if len(kept) > 0 {
+		updated = strings.Join(kept, "\n") + "\n"
+	}
+
+	return writeIfChanged(path, []byte(updated), perm)
+}
+
+// writeIfChanged atomically replaces the file at path with contents unless it
+// already holds them, keeping the mode of an existing file, and reports
+// whether it wrote anything.
+func writeIfChanged(path string, contents []byte, perm os.FileMode) (bool, error) {
+	current, err := os.ReadFile(path)
+	if err == nil && string(current) == string(contents) {
+		return false, nil
+	}
+
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode() & os.ModePerm
+	}
+
+	tmp := stagedPath(path)
+	os.Remove(tmp)
+	if err = writeFileSync(tmp, contents, perm); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+
+	syncDir(filepath.Dir(path))
+	return true, nil
+}
+
+// shellQuote quotes s for /bin/sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// restart stops the running crond, if there is one, and starts a new one,
+// which reads the updated crontab.
+func (c crondService) restart() error {
+	if pid := c.pid(); pid > 0 {
+		slog.Debug("stopping crond", slog.Int("pid", pid))
+		proc, err := os.FindProcess(pid)
+		if err != nil {
+			return err
+		}
+
+		if err = proc.Signal(syscall.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			return fmt.Errorf("could not stop crond (pid %d): %w", pid, err)
+		}
+
+		if !waitForExit(pid, c.timeout) {
+			return fmt.Errorf("crond (pid %d) did not stop within %s", pid, c.timeout)
+		}
+	}
+
+	// crond forks into the background itself, in a session of its own so it
+	// does not go away with this process
+	cmd := exec.Command(c.command[0], c.command[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("could not start crond: %w", err)
+	}
+
+	slog.Info("restarted crond")
+	return nil
+}
+
+// pid returns the PID of the running crond, from its pid file or else from
+// the process list, or 0 if it does not run.
+func (c crondService) pid() int {
+	if contents, err := os.ReadFile(c.pidFile); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(contents))); err == nil && processAlive(pid) {
+			return pid
+		}
+	}
+
+	return findCrondPID()
+}
+
+func findCrondPID() int {
+	for pid, name := range listProcesses() {
+		if name == "crond" && processAlive(pid) {
+			return pid
+		}
+	}
+
+	return 0
+}
+
+// listProcesses returns the name of every running process by PID, as ps
+// lists them, or nil if ps cannot be run.
+func listProcesses() map[int]string {
 	psCmd := exec.Command("/bin/ps")
 
 	stdout := &strings.Builder{}
 	psCmd.Stdout = stdout
 	if err := psCmd.Run(); err != nil {
-		return 0
+		return nil
 	}
 
+	processes := map[int]string{}
 	lineScanner := bufio.NewScanner(strings.NewReader(stdout.String()))
 	for lineScanner.Scan() {
-		line := lineScanner.Text()
-		if strings.HasSuffix(strings.TrimSpace(line), "crond") {
-			fields := strings.Fields(strings.TrimSpace(line))
-			pid, _ := strconv.Atoi(fields[0])
-			return pid
+		fields := strings.Fields(lineScanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		if pid, err := strconv.Atoi(fields[0]); err == nil {
+			processes[pid] = fields[len(fields)-1]
 		}
 	}
 
-	return 0
+	return processes
 }
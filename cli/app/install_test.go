@@ -0,0 +1,219 @@
+package app
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+	. "github.com/onsi/gomega"
+)
+
+func TestUpdateManagedBlock(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := t.TempDir()
+	crontab := filepath.Join(dir, "root")
+	exePath := "/opt/esxi-acme-mgmt/bin/esxi-acme-mgmt"
+	legacy := legacyCronLine(exePath)
+
+	// what earlier versions left after two runs
+	existing := "#min hour day mon dow command\n1 1 * * * /sbin/tmpwatch.py\n" +
+		"\n0\t0\t*\t*\t0\t" + exePath + " provision" +
+		"\n0\t0\t*\t*\t0\t" + exePath + " provision"
+	Expect(os.WriteFile(crontab, []byte(existing), 0o600)).To(Succeed())
+
+	line := "0 0 * * * " + exePath + " provision"
+	Expect(updateManagedBlock(crontab, []string{line}, legacy, 0o600)).To(BeTrue())
+	Expect(os.ReadFile(crontab)).To(BeEquivalentTo("#min hour day mon dow command\n1 1 * * * /sbin/tmpwatch.py\n" +
+		managedBlockBegin + "\n" + line + "\n" + managedBlockEnd + "\n"))
+	Expect(readManagedBlock(crontab)).To(Equal([]string{line}))
+
+	// installing again changes nothing
+	Expect(updateManagedBlock(crontab, []string{line}, legacy, 0o600)).To(BeFalse())
+
+	// a new schedule replaces the block
+	line = "30 2 * * 1 " + exePath + " provision"
+	Expect(updateManagedBlock(crontab, []string{line}, legacy, 0o600)).To(BeTrue())
+	contents, err := os.ReadFile(crontab)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(strings.Count(string(contents), managedBlockBegin)).To(Equal(1))
+	Expect(string(contents)).To(ContainSubstring(line))
+
+	Expect(updateManagedBlock(crontab, nil, legacy, 0o600)).To(BeTrue())
+	Expect(os.ReadFile(crontab)).To(BeEquivalentTo("#min hour day mon dow command\n1 1 * * * /sbin/tmpwatch.py\n"))
+	Expect(updateManagedBlock(crontab, nil, legacy, 0o600)).To(BeFalse())
+	Expect(readManagedBlock(crontab)).To(BeNil())
+
+	Expect(updateManagedBlock(filepath.Join(dir, "missing"), nil, legacy, 0o600)).To(BeFalse())
+	Expect(filepath.Join(dir, "missing")).NotTo(BeAnExistingFile())
+
+	// boot scripts end with an exit the block has to come before
+	bootScript := filepath.Join(dir, "local.sh")
+	original := "#!/bin/sh ++group=host/vim/vmvisor/boot\n# local configuration options\nexit 0\n"
+	Expect(os.WriteFile(bootScript, []byte(original), 0o755)).To(Succeed())
+	Expect(updateManagedBlock(bootScript, []string{"echo hook"}, nil, 0o755)).To(BeTrue())
+	Expect(os.ReadFile(bootScript)).To(BeEquivalentTo("#!/bin/sh ++group=host/vim/vmvisor/boot\n# local configuration options\n" +
+		managedBlockBegin + "\necho hook\n" + managedBlockEnd + "\nexit 0\n"))
+	Expect(updateManagedBlock(bootScript, nil, nil, 0o755)).To(BeTrue())
+	Expect(os.ReadFile(bootScript)).To(BeEquivalentTo(original))
+}
+
+func TestInstallSchedule(t *testing.T) {
+	RegisterTestingT(t)
+
+	baseDir, dir := t.TempDir(), t.TempDir()
+	started := filepath.Join(dir, "started")
+	writeInitScript(dir, "crond", "echo started >> "+started)
+
+	i := &InstallCommand{Schedule: "15  3 * * *"}
+	i.CrontabFile = filepath.Join(dir, "root")
+	i.BootScript = filepath.Join(dir, "local.sh")
+	Expect(i.AfterApply(RunOptions{BaseDir: baseDir, AccountEmail: "admin@example.com", Provider: "route53"})).To(Succeed())
+	i.backupScript = ""
+	i.crond = crondService{pidFile: filepath.Join(dir, "crond.pid"), command: []string{filepath.Join(dir, "crond")}, timeout: time.Second}
+
+	var out strings.Builder
+	err := i.check(&out)
+	Expect(err).To(MatchError(ContainSubstring("not installed")))
+	Expect(exitCode(err)).To(Equal(ExitError))
+	// a failure, not a result like exitStatus
+	Expect(errors.As(err, new(exitStatus))).To(BeFalse())
+	Expect(out.String()).To(ContainSubstring("missing"))
+
+	Expect(i.Run(&kong.Context{})).To(Succeed())
+	Expect(os.ReadFile(started)).To(BeEquivalentTo("started\n"))
+	Expect(filepath.Join(baseDir, ".config", scheduleEnvFile)).To(BeAnExistingFile())
+
+	out.Reset()
+	Expect(i.check(&out)).To(Succeed())
+	Expect(out.String()).NotTo(ContainSubstring("missing"))
+
+	// installing again leaves crond alone
+	Expect(i.Run(&kong.Context{})).To(Succeed())
+	Expect(os.ReadFile(started)).To(BeEquivalentTo("started\n"))
+
+	// a reboot brings back the crontab of the boot image, and the boot hook
+	// puts the entry back
+	Expect(os.WriteFile(i.CrontabFile, []byte("1 1 * * * /sbin/tmpwatch.py\n"), 0o600)).To(Succeed())
+	out.Reset()
+	Expect(i.check(&out)).To(HaveOccurred())
+	Expect(exec.Command("/bin/sh", i.BootScript).Run()).To(Succeed())
+	Expect(os.ReadFile(started)).To(BeEquivalentTo("started\nstarted\n"))
+	Expect(i.check(&out)).To(Succeed())
+
+	// the hook only adds the entry once
+	Expect(exec.Command("/bin/sh", i.BootScript).Run()).To(Succeed())
+	Expect(readManagedBlock(i.CrontabFile)).To(Equal(i.cronEntry()))
+	Expect(os.ReadFile(started)).To(BeEquivalentTo("started\nstarted\n"))
+
+	// a different schedule is reported as outdated
+	i.Schedule = "0 4 * * *"
+	out.Reset()
+	err = i.check(&out)
+	Expect(exitCode(err)).To(Equal(ExitError))
+	Expect(out.String()).To(ContainSubstring("outdated"))
+
+	u := &UninstallCommand{schedulePaths: i.schedulePaths}
+	Expect(u.AfterApply(RunOptions{BaseDir: baseDir})).To(Succeed())
+	u.backupScript = ""
+	u.crond = i.crond
+	Expect(u.Run()).To(Succeed())
+	Expect(readManagedBlock(i.CrontabFile)).To(BeNil())
+	Expect(readManagedBlock(i.BootScript)).To(BeNil())
+	Expect(filepath.Join(baseDir, ".config", scheduleEnvFile)).NotTo(BeAnExistingFile())
+}
+
+func TestScheduleEnvironment(t *testing.T) {
+	RegisterTestingT(t)
+
+	opts := RunOptions{
+		AccountEmail:    "o'brien@example.com",
+		Provider:        "route53",
+		Domains:         []string{"a.example", "b.example"},
+		HostFQDN:        true,
+		KeepBackups:     3,
+		RestartTimeout:  5 * time.Minute,
+		Trigger:         "cli",
+		TargetDirectory: "/etc/vmware/ssl",
+	}
+
+	env := scheduleEnvironment(opts, []string{"--region", "us-east-1", "--tags", "team=ops,env=prod"})
+	Expect(env).To(ContainElements(
+		`LE_ESXI_DNS_PROVIDER='route53'`,
+		`LE_ESXI_DOMAINS='a.example,b.example'`,
+		`LE_ESXI_HOST_FQDN='true'`,
+		`LE_ESXI_KEEP_BACKUPS='3'`,
+		`LE_ESXI_RESTART_TIMEOUT='5m0s'`,
+		`LE_ESXI_PROVIDER_ARGS='--region,us-east-1,--tags,team=ops\,env=prod'`,
+		`LE_ESXI_TRIGGER='cron'`,
+	))
+	Expect(strings.Join(env, "\n")).NotTo(ContainSubstring("LE_ESXI_EAB_KID"))
+
+	// the file has to read back the same in the shell crond runs
+	envFile := filepath.Join(t.TempDir(), scheduleEnvFile)
+	Expect(os.WriteFile(envFile, []byte(strings.Join(env, "\n")+"\n"), 0o600)).To(Succeed())
+	out, err := exec.Command("/bin/sh", "-c", "set -a; . "+shellQuote(envFile)+`; printf %s "$LE_ESXI_ACCOUNT_EMAIL"`).Output()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(string(out)).To(Equal(opts.AccountEmail))
+}
+
+func TestProviderArgsFromScheduleEnvironment(t *testing.T) {
+	RegisterTestingT(t)
+
+	args := []string{"--region", "us-east-1", "--tags", "team=ops,env=prod"}
+	envFile := filepath.Join(t.TempDir(), scheduleEnvFile)
+	env := scheduleEnvironment(RunOptions{}, args)
+	Expect(os.WriteFile(envFile, []byte(strings.Join(env, "\n")+"\n"), 0o600)).To(Succeed())
+	out, err := exec.Command("/bin/sh", "-c", "set -a; . "+shellQuote(envFile)+`; printf %s "$LE_ESXI_PROVIDER_ARGS"`).Output()
+	Expect(err).NotTo(HaveOccurred())
+	t.Setenv("LE_ESXI_PROVIDER_ARGS", string(out))
+
+	for _, command := range []string{"provision", "daemon"} {
+		_, parsed, err := parseTestCommandLine(t.TempDir(), command)
+		Expect(err).NotTo(HaveOccurred())
+
+		s := parsed.Provision
+		if command == "daemon" {
+			s = &parsed.Daemon.ProvisionCommand
+		}
+		Expect(s.ProviderArgs).To(Equal(args), command)
+	}
+
+	// arguments on the command line replace the ones in the environment
+	_, parsed, err := parseTestCommandLine(t.TempDir(), "provision", "--profile", "dns")
+	Expect(err).NotTo(HaveOccurred())
+	Expect(parsed.Provision.ProviderArgs).To(Equal([]string{"--profile", "dns"}))
+}
+
+func TestRestartCrond(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := t.TempDir()
+	started := filepath.Join(dir, "started")
+	writeInitScript(dir, "crond", "touch "+started)
+
+	// a crond that is running
+	running := exec.Command("sleep", "60")
+	Expect(running.Start()).To(Succeed())
+	exited := make(chan error, 1)
+	go func() { exited <- running.Wait() }()
+
+	pidFile := filepath.Join(dir, "crond.pid")
+	Expect(os.WriteFile(pidFile, []byte(strconv.Itoa(running.Process.Pid)+"\n"), 0o644)).To(Succeed())
+
+	c := crondService{pidFile: pidFile, command: []string{filepath.Join(dir, "crond")}, timeout: 5 * time.Second}
+	Expect(c.restart()).To(Succeed())
+	Eventually(exited).Should(Receive())
+	Expect(started).To(BeAnExistingFile())
+
+	// nothing to stop
+	Expect(os.Remove(started)).To(Succeed())
+	Expect(c.restart()).To(Succeed())
+	Expect(started).To(BeAnExistingFile())
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type keyType string
+
+const (
+	keyTypeEC256   keyType = "ec256"
+	keyTypeEC384   keyType = "ec384"
+	keyTypeRSA2048 keyType = "rsa2048"
+	keyTypeRSA3072 keyType = "rsa3072"
+	keyTypeRSA4096 keyType = "rsa4096"
+
+	// keyTypeEnum is used in kong enum tags and must list every key type above
+	keyTypeEnum = "ec256,ec384,rsa2048,rsa3072,rsa4096"
+)
+
+func generatePrivateKey(kt keyType, r io.Reader) (crypto.Signer, error) {
+	switch kt {
+	case keyTypeEC256:
+		return ecdsa.GenerateKey(elliptic.P256(), r)
+	case keyTypeEC384:
+		return ecdsa.GenerateKey(elliptic.P384(), r)
+	case keyTypeRSA2048:
+		return rsa.GenerateKey(r, 2048)
+	case keyTypeRSA3072:
+		return rsa.GenerateKey(r, 3072)
+	case keyTypeRSA4096:
+		return rsa.GenerateKey(r, 4096)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", kt)
+	}
+}
+
+// publicKeyType maps a public key back to the key type that would generate it.
+func publicKeyType(pub crypto.PublicKey) (keyType, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return keyTypeEC256, nil
+		case elliptic.P384():
+			return keyTypeEC384, nil
+		}
+		return "", fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+	case *rsa.PublicKey:
+		switch k.N.BitLen() {
+		case 2048:
+			return keyTypeRSA2048, nil
+		case 3072:
+			return keyTypeRSA3072, nil
+		case 4096:
+			return keyTypeRSA4096, nil
+		}
+		return "", fmt.Errorf("unsupported RSA key size %d", k.N.BitLen())
+	default:
+		return "", fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// samePublicKey reports whether a and b are the same key.
+func samePublicKey(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
+
+func privateKeyType(key crypto.Signer) (keyType, error) {
+	return publicKeyType(key.Public())
+}
+
+// encodePrivateKey PEM encodes key using the traditional encoding for its
+// algorithm, which is what ESXi's own tooling writes.
+func encodePrivateKey(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// parsePrivateKey decodes the first private key in pemBytes, accepting PKCS#8,
+// PKCS#1 and SEC 1 (EC) encodings.
+func parsePrivateKey(pemBytes []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			return nil, errors.New("no private key found in PEM data")
+		}
+
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, fmt.Errorf("unsupported private key type %T", key)
+			}
+			return signer, nil
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		}
+	}
+}
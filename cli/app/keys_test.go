@@ -0,0 +1,107 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestKeyTypesRoundTrip(t *testing.T) {
+	RegisterTestingT(t)
+
+	for _, kt := range []keyType{keyTypeEC256, keyTypeEC384, keyTypeRSA2048} {
+		key, err := generatePrivateKey(kt, rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(privateKeyType(key)).To(Equal(kt))
+
+		encoded, err := encodePrivateKey(key)
+		Expect(err).NotTo(HaveOccurred())
+
+		parsed, err := parsePrivateKey(encoded)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed.Public()).To(Equal(key.Public()))
+
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		Expect(err).NotTo(HaveOccurred())
+
+		parsed, err = parsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed.Public()).To(Equal(key.Public()))
+	}
+
+	_, err := generatePrivateKey("dsa1024", rand.Reader)
+	Expect(err).To(HaveOccurred())
+}
+
+func TestReadOrCreatePrivateKey(t *testing.T) {
+	RegisterTestingT(t)
+
+	s := &ProvisionCommand{}
+	keyPath := filepath.Join(t.TempDir(), "acme.cpk")
+
+	created, isNew, err := s.readOrCreatePrivateKey(keyPath, keyTypeEC384, rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(isNew).To(BeTrue())
+
+	read, isNew, err := s.readOrCreatePrivateKey(keyPath, keyTypeEC384, rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(isNew).To(BeFalse())
+	Expect(read.Public()).To(Equal(created.Public()))
+
+	Expect(os.WriteFile(keyPath+".bad", []byte("not a key"), 0o600)).To(Succeed())
+	_, _, err = s.readOrCreatePrivateKey(keyPath+".bad", keyTypeEC256, rand.Reader)
+	Expect(err).To(HaveOccurred())
+}
+
+func TestSelectCertificateKey(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := t.TempDir()
+	s := &ProvisionCommand{configDir: dir, keyType: keyTypeEC256}
+
+	existing, err := generatePrivateKey(keyTypeEC256, rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	keyPEM, err := encodePrivateKey(existing)
+	Expect(err).NotTo(HaveOccurred())
+
+	keyPath := filepath.Join(dir, "abc.key")
+	Expect(os.WriteFile(keyPath, keyPEM, 0o600)).To(Succeed())
+	current := &acmeCertWithPath{KeyPath: keyPath, KeyRenewals: 2}
+
+	// every 3 renewals: the third certificate still uses the key
+	s.keyRotationEvery, err = parseKeyRotation("3")
+	Expect(err).NotTo(HaveOccurred())
+	Expect(s.selectCertificateKey(current)).To(Equal(3))
+	Expect(s.certPrivateKey.Public()).To(Equal(existing.Public()))
+
+	current.KeyRenewals = 3
+	Expect(s.selectCertificateKey(current)).To(Equal(1))
+	Expect(s.certPrivateKey.Public()).NotTo(Equal(existing.Public()))
+
+	s.keyRotationEvery, _ = parseKeyRotation("never")
+	Expect(s.selectCertificateKey(current)).To(Equal(4))
+	Expect(s.certPrivateKey.Public()).To(Equal(existing.Public()))
+
+	// a key type change always rotates
+	s.keyType = keyTypeEC384
+	Expect(s.selectCertificateKey(current)).To(Equal(1))
+	Expect(privateKeyType(s.certPrivateKey)).To(Equal(keyTypeEC384))
+
+	// the legacy acme.cpk is kept only when rotation is disabled
+	s.keyType = keyTypeEC256
+	Expect(os.WriteFile(filepath.Join(dir, "acme.cpk"), keyPEM, 0o600)).To(Succeed())
+	Expect(s.selectCertificateKey(nil)).To(Equal(2))
+	Expect(s.certPrivateKey.Public()).To(Equal(existing.Public()))
+
+	s.keyRotationEvery, _ = parseKeyRotation("always")
+	Expect(s.selectCertificateKey(nil)).To(Equal(1))
+	Expect(s.certPrivateKey.Public()).NotTo(Equal(existing.Public()))
+
+	_, err = parseKeyRotation("sometimes")
+	Expect(err).To(HaveOccurred())
+}
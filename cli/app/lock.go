@@ -0,0 +1,178 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// runLockFile is the file in the run directory that runs lock. It keeps the
+// name of the pid file it replaced, and still starts with the PID of the run
+// holding it.
+const runLockFile = "pid"
+
+// errRunLockEmpty is returned for the lock file of a run that released it.
+var errRunLockEmpty = errors.New("run lock is empty")
+
+// runLockPollInterval is how often a run waiting for the lock tries again.
+const runLockPollInterval = 500 * time.Millisecond
+
+// runLock is an advisory lock that keeps provision runs from overlapping. The
+// kernel releases it when its process dies, so a killed run or a reboot does
+// not leave it held.
+type runLock struct {
+	file *os.File
+}
+
+// runLockOwner is what the run holding the lock records about itself.
+type runLockOwner struct {
+	PID       int
+	StartedAt time.Time
+	Command   string
+}
+
+// acquireRunLock takes the run lock for command. If another run holds it, it
+// fails with ExitLockHeld, or with wait set waits until the lock is free or
+// ctx is done.
+func acquireRunLock(ctx context.Context, runDir, command string, wait bool) (*runLock, error) {
+	if err := os.MkdirAll(runDir, 0o700); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(runDir, runLockFile)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open run lock: %w", err)
+	}
+
+	logged := false
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("could not lock %s: %w", path, err)
+		}
+
+		owner, _ := readRunLockOwner(path)
+		if !wait {
+			f.Close()
+			return nil, classify(ExitLockHeld, fmt.Errorf("another run is in progress: %s", owner))
+		}
+
+		if !logged {
+			slog.Info("waiting for another run to finish", slog.String("holder", owner.String()))
+			logged = true
+		}
+
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(runLockPollInterval):
+		}
+	}
+
+	owner := runLockOwner{PID: os.Getpid(), StartedAt: time.Now(), Command: command}
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(owner.encode()), 0)
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not record run lock owner: %w", err)
+	}
+
+	return &runLock{file: f}, nil
+}
+
+// release empties the lock file and unlocks it. The file is left in place:
+// removing it would let a run that is waiting on it lock a file nobody else
+// can see.
+func (l *runLock) release() {
+	l.file.Truncate(0)
+	l.file.Close()
+}
+
+// runLockHolder returns the owner of the lock at path, and whether it is
+// another process that still runs. It only reads the file, as probing the
+// lock would hold it for a moment and turn away a run starting then. A run
+// empties the file when it releases the lock; one that was killed leaves its
+// PID behind, which no longer runs or was reused by another process.
+func runLockHolder(path string) (runLockOwner, bool, error) {
+	owner, err := readRunLockOwner(path)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errRunLockEmpty) {
+		return runLockOwner{}, false, nil
+	}
+
+	if err != nil {
+		return runLockOwner{}, false, err
+	}
+
+	return owner, processAlive(owner.PID), nil
+}
+
+// readRunLockOwner returns what the run holding the lock at path recorded.
+// The lock file of the pid file era holds only the PID.
+func readRunLockOwner(path string) (runLockOwner, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return runLockOwner{}, err
+	}
+	defer f.Close()
+
+	var owner runLockOwner
+	scanner := bufio.NewScanner(f)
+	for i := 0; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch i {
+		case 0:
+			if owner.PID, err = strconv.Atoi(line); err != nil {
+				return runLockOwner{}, fmt.Errorf("run lock does not start with a PID: %q", line)
+			}
+		case 1:
+			owner.StartedAt, _ = time.Parse(time.RFC3339, line)
+		case 2:
+			owner.Command = line
+		}
+	}
+
+	if owner.PID == 0 {
+		return runLockOwner{}, errRunLockEmpty
+	}
+
+	return owner, scanner.Err()
+}
+
+func (o runLockOwner) encode() string {
+	return fmt.Sprintf("%d\n%s\n%s\n", o.PID, o.StartedAt.Format(time.RFC3339), o.Command)
+}
+
+func (o runLockOwner) String() string {
+	if o.PID == 0 {
+		return "unknown process"
+	}
+
+	s := "pid " + strconv.Itoa(o.PID)
+	if o.Command != "" {
+		s = o.Command + " " + s
+	}
+
+	if !o.StartedAt.IsZero() {
+		s += ", started " + o.StartedAt.Format(time.RFC3339)
+	}
+
+	return s
+}
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestRunLock(t *testing.T) {
+	RegisterTestingT(t)
+
+	runDir := filepath.Join(t.TempDir(), "run")
+	lockPath := filepath.Join(runDir, runLockFile)
+
+	lock, err := acquireRunLock(context.Background(), runDir, "provision", false)
+	Expect(err).NotTo(HaveOccurred())
+	info, err := os.Stat(runDir)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(info.Mode().Perm()).To(Equal(os.FileMode(0o700)))
+
+	owner, err := readRunLockOwner(lockPath)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(owner.PID).To(Equal(os.Getpid()))
+	Expect(owner.Command).To(Equal("provision"))
+	Expect(owner.StartedAt).To(BeTemporally("~", time.Now(), 2*time.Second))
+
+	_, err = acquireRunLock(context.Background(), runDir, "provision", false)
+	Expect(exitCode(err)).To(Equal(ExitLockHeld))
+	Expect(err).To(MatchError(ContainSubstring("pid")))
+
+	// waiting gives up with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = acquireRunLock(ctx, runDir, "provision", true)
+	Expect(err).To(MatchError(context.DeadlineExceeded))
+
+	// and gets the lock once it is released
+	acquired := make(chan *runLock, 1)
+	go func() {
+		// a failure leaves the channel empty
+		if waited, err := acquireRunLock(context.Background(), runDir, "daemon", true); err == nil {
+			acquired <- waited
+		}
+	}()
+	Consistently(acquired, 200*time.Millisecond).ShouldNot(Receive())
+	lock.release()
+
+	var waited *runLock
+	Eventually(acquired, 2*time.Second).Should(Receive(&waited))
+	owner, err = readRunLockOwner(lockPath)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(owner.Command).To(Equal("daemon"))
+
+	waited.release()
+	_, err = readRunLockOwner(lockPath)
+	Expect(err).To(MatchError(errRunLockEmpty))
+}
+
+func TestRunLockHolder(t *testing.T) {
+	RegisterTestingT(t)
+
+	runDir := t.TempDir()
+	lockPath := filepath.Join(runDir, runLockFile)
+	_, held, err := runLockHolder(lockPath)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(held).To(BeFalse())
+
+	other := exec.Command("sleep", "60")
+	Expect(other.Start()).To(Succeed())
+	t.Cleanup(func() { other.Process.Kill(); other.Wait() })
+
+	for _, tc := range []struct {
+		contents string
+		held     bool
+	}{
+		{contents: runLockOwner{PID: other.Process.Pid, StartedAt: time.Now(), Command: "daemon"}.encode(), held: true},
+		{contents: "", held: false},
+		// left by a run that was killed
+		{contents: "999999999\n", held: false},
+	} {
+		Expect(os.WriteFile(lockPath, []byte(tc.contents), 0o600)).To(Succeed())
+		owner, held, err := runLockHolder(lockPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(held).To(Equal(tc.held), "lock file %q", tc.contents)
+		if tc.held {
+			Expect(owner.Command).To(Equal("daemon"))
+		}
+	}
+}
+
+func TestRunLockLeftByKilledRun(t *testing.T) {
+	RegisterTestingT(t)
+
+	// a pid file from before the lock, of a run that did not remove it
+	runDir := t.TempDir()
+	Expect(os.WriteFile(filepath.Join(runDir, runLockFile), []byte("999999999"), 0o600)).To(Succeed())
+
+	lock, err := acquireRunLock(context.Background(), runDir, "provision", false)
+	Expect(err).NotTo(HaveOccurred())
+	defer lock.release()
+
+	owner, err := readRunLockOwner(filepath.Join(runDir, runLockFile))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(owner.PID).To(Equal(os.Getpid()))
+}
@@ -1,14 +1,12 @@
 package app
 
 import (
-	"bytes"
 	"context"
 	"crypto"
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
@@ -17,12 +15,16 @@ import (
 	"io"
 	"io/fs"
 	"log/slog"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/alecthomas/kong"
 	"github.com/jghiloni/esxi-acme-mgmt/plugins/common"
 	"github.com/mholt/acmez/v3"
 	"github.com/mholt/acmez/v3/acme"
@@ -35,6 +37,11 @@ const (
 )
 
 type ProvisionCommand struct {
+	ProviderArgs       []string `optional:"true" arg:"" passthrough:"all" help:"Arguments that will be passed to the provider"`
+	JoinedProviderArgs []string `name:"provider-args" env:"LE_ESXI_PROVIDER_ARGS" hidden:"true" help:"Arguments that will be passed to the provider if none are given, separated by commas. A comma in an argument is escaped with a backslash"`
+	ReportFile         string   `env:"LE_ESXI_REPORT_FILE" type:"path" help:"Write a JSON summary of the run to this file"`
+	Wait               bool     `env:"LE_ESXI_WAIT" help:"Wait for a run in progress to finish instead of failing"`
+
 	configDir         string
 	certsDir          string
 	pluginDir         string
@@ -43,12 +50,34 @@ type ProvisionCommand struct {
 	dnsProviderName   string
 	acmeURL           string
 	accountEmail      string
+	includeHostFQDN   bool
+	localFQDN         func() (string, error)
+	domains           []string
+	ipAddresses       []string
+	keyType           keyType
+	accountKeyType    keyType
+	keyRotationEvery  int
+	renewBeforeDays   int
+	renewPercent      int
+	castorePrune      []string
+	eab               *acme.EAB
 	createAccount     bool
 	accountPrivateKey crypto.Signer
 	certPrivateKey    crypto.Signer
+	activation        activation
+	history           historyJournal
+	pruner            *pruner
+}
+
+func (*ProvisionCommand) Help() string {
+	return exitCodeHelp
 }
 
-func (s *ProvisionCommand) BeforeApply(opts RunOptions) error {
+func (s *ProvisionCommand) AfterApply(opts RunOptions, kctx *kong.Context) error {
+	if len(s.ProviderArgs) == 0 {
+		s.ProviderArgs = s.JoinedProviderArgs
+	}
+
 	s.configDir = filepath.Join(opts.BaseDir, ".config")
 	s.certsDir = filepath.Join(opts.BaseDir, "certs")
 	s.runDir = filepath.Join(opts.BaseDir, "run")
@@ -57,9 +86,65 @@ func (s *ProvisionCommand) BeforeApply(opts RunOptions) error {
 	s.dnsProviderName = opts.Provider
 	s.acmeURL = opts.ACMEDirectoryURL
 	s.accountEmail = opts.AccountEmail
+	s.includeHostFQDN = opts.HostFQDN
+	s.localFQDN = getLocalFQDN
+	s.domains = opts.Domains
+	s.keyType = keyType(opts.KeyType)
+	s.accountKeyType = keyType(opts.AccountKeyType)
+	s.renewBeforeDays = opts.RenewBeforeDays
+	s.renewPercent = opts.RemainingPercent
+	s.castorePrune = opts.CAStorePrune
+	s.activation = newActivation(opts)
+	// provision or the daemon embedding it
+	s.history = newHistoryJournal(opts, kctx.Selected().Name)
+	if opts.AutoPrune {
+		p := newPruner(opts)
+		s.pruner = &p
+	}
+
+	var err error
+	if s.keyRotationEvery, err = parseKeyRotation(opts.KeyRotation); err != nil {
+		return err
+	}
 
-	err := os.MkdirAll(s.configDir, 0o700)
-	if err != nil {
+	if s.renewPercent < 0 || s.renewPercent > 100 {
+		return fmt.Errorf("--renew-remaining-percent must be between 0 and 100, got %d", s.renewPercent)
+	}
+
+	for _, addr := range opts.IPAddresses {
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if ip == nil {
+			return fmt.Errorf("%q is not a valid IP address", addr)
+		}
+		s.ipAddresses = append(s.ipAddresses, ip.String())
+	}
+
+	// RFC 8738 leaves only http-01 and tls-alpn-01 to validate IP identifiers,
+	// and dns-01 is the only challenge there is a solver for
+	if len(s.ipAddresses) > 0 {
+		return classify(ExitUsage, fmt.Errorf("--ip-address %s: IP identifiers cannot be validated with the dns-01 challenge, the only one this tool solves", strings.Join(s.ipAddresses, ",")))
+	}
+
+	if (opts.EABKeyID == "") != (opts.EABHMACKey == "") {
+		return errors.New("--eab-kid and --eab-hmac-key must be used together")
+	}
+
+	if opts.EABKeyID != "" {
+		// checked now rather than when the account is registered, which for a
+		// scheduled run may be long after it was set up. The ACME client
+		// expects the key without padding.
+		macKey := strings.TrimRight(strings.TrimSpace(opts.EABHMACKey), "=")
+		if _, err = base64.RawURLEncoding.DecodeString(macKey); err != nil {
+			return fmt.Errorf("--eab-hmac-key must be base64url encoded: %w", err)
+		}
+		s.eab = &acme.EAB{KeyID: opts.EABKeyID, MACKey: macKey}
+	}
+
+	if !s.includeHostFQDN && len(s.domains) == 0 && len(s.ipAddresses) == 0 {
+		return errors.New("at least one identifier is required when the host FQDN is excluded")
+	}
+
+	if err = os.MkdirAll(s.configDir, 0o700); err != nil {
 		return fmt.Errorf("could not ensure config directory exists: %w", err)
 	}
 
@@ -71,162 +156,371 @@ func (s *ProvisionCommand) BeforeApply(opts RunOptions) error {
 		return fmt.Errorf("could not ensure run directory exists: %w", err)
 	}
 
-	s.accountPrivateKey, s.createAccount, err = s.readOrCreatePrivateKey(filepath.Join(s.configDir, "acme.apk"), elliptic.P256(), rand.Reader)
+	s.accountPrivateKey, s.createAccount, err = s.readOrCreatePrivateKey(filepath.Join(s.configDir, "acme.apk"), s.accountKeyType, rand.Reader)
 	if err != nil {
 		return fmt.Errorf("get account private key: %w", err)
 	}
 
-	s.certPrivateKey, _, err = s.readOrCreatePrivateKey(filepath.Join(s.configDir, "acme.cpk"), elliptic.P256(), rand.Reader)
-	if err != nil {
-		return fmt.Errorf("get cert private key: %w", err)
+	// the account key cannot simply be replaced without losing the account, so
+	// a different type only applies to newly generated account keys
+	if kt, _ := privateKeyType(s.accountPrivateKey); kt != s.accountKeyType {
+		slog.Warn("existing account key does not match the configured account key type",
+			slog.String("existing", string(kt)), slog.String("configured", string(s.accountKeyType)))
 	}
 
 	return nil
 }
 
-func (s *ProvisionCommand) Run(ctx context.Context, providerArgs []string) error {
-	pidFile, err := os.OpenFile(filepath.Join(s.runDir, "pid"), os.O_CREATE|os.O_EXCL, 0o600)
-	if errors.Is(err, fs.ErrExist) {
-		return errors.New("a current start command is currently in progress")
+func (s *ProvisionCommand) Run(ctx context.Context) error {
+	return s.reportRun(func(report *provisionReport) error {
+		lock, err := acquireRunLock(ctx, s.runDir, "provision", s.Wait)
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+
+		return s.provision(ctx, report)
+	})
+}
+
+// reportRun runs provision with a new report, and writes the report if a
+// report file is set.
+func (s *ProvisionCommand) reportRun(provision func(*provisionReport) error) error {
+	report := &provisionReport{StartedAt: time.Now(), DirectoryURL: s.acmeURL}
+	err := provision(report)
+	report.finish(err)
+
+	if s.ReportFile != "" {
+		if werr := report.write(s.ReportFile); werr != nil {
+			slog.Error("could not write run report", slog.String("report-file", s.ReportFile), slog.Any("error", werr))
+		}
 	}
-	defer func() {
-		os.Remove(pidFile.Name())
-	}()
-	fmt.Fprintf(pidFile, "%d", os.Getpid())
-	pidFile.Close()
 
-	needsRenewal, err := s.checkIfCertNeedsRenewal(ctx)
+	return err
+}
+
+// provision renews the certificate if it is due. The caller holds the run
+// lock, so a swap left behind by a run that was killed is recovered first.
+func (s *ProvisionCommand) provision(ctx context.Context, report *provisionReport) (err error) {
+	if err = recoverSwap(s.runDir, s.outputDir, s.history); err != nil {
+		return classify(ExitInstallFailure, fmt.Errorf("could not recover an interrupted certificate swap: %w", err))
+	}
+
+	done := report.phase("check")
+	sans, err := s.certificateSANs()
+	if err != nil {
+		return err
+	}
+	report.Identifiers = sans
+
+	current, err := readActiveCertMetadata(s.outputDir)
+	if err != nil {
+		return err
+	}
+	report.PreviousCertificateHash = certificateHash(current)
+
+	// renewal info has to come from the CA that issued the certificate
+	caURL := s.acmeURL
+	if current != nil && current.CA != "" {
+		caURL = current.CA
+	}
+
+	needsRenewal, err := s.checkIfCertNeedsRenewal(ctx, newACMEClient(caURL), current, sans)
+	done()
 	if err != nil {
 		return err
 	}
 
 	if !needsRenewal {
 		slog.Info("no certs currently need renewal")
-		return nil
+		return exitStatus(ExitNotDue)
 	}
 
-	account := acme.Account{
-		Contact:              []string{fmt.Sprintf("mailto:%s", s.accountEmail)},
-		TermsOfServiceAgreed: true,
-		PrivateKey:           s.accountPrivateKey,
-	}
+	// from here on, every attempt ends up in the install history
+	entry := historyEntry{Action: historyActionInstall, OldHash: report.PreviousCertificateHash, CAURL: s.acmeURL}
+	defer func() {
+		s.history.record(entry, err)
+	}()
 
-	solver, err := common.LoadProvider(s.pluginDir, s.dnsProviderName, providerArgs)
+	solver, err := common.LoadProvider(s.pluginDir, s.dnsProviderName, s.ProviderArgs)
 	if err != nil {
-		return fmt.Errorf("could not load DNS solver plugin for provider %s: %w", s.dnsProviderName, err)
+		return classify(ExitDNSFailure, fmt.Errorf("could not load DNS solver plugin for provider %s: %w", s.dnsProviderName, err))
+	}
+
+	// executable providers run as a child process that has to be shut down
+	if closer, ok := solver.(io.Closer); ok {
+		defer closer.Close()
 	}
 
 	client := acmez.Client{
-		Client: &acme.Client{
-			Directory:   s.acmeURL,
-			Logger:      slog.Default(),
-			UserAgent:   Name,
-			PollTimeout: time.Minute,
-		},
+		Client: newACMEClient(s.acmeURL),
 		ChallengeSolvers: map[string]acmez.Solver{
-			acme.ChallengeTypeDNS01: solver,
+			acme.ChallengeTypeDNS01: dnsSolver{solver},
 		},
 	}
+	client.Logger = slog.New(orderRecorder{Handler: client.Logger.Handler(), orderURL: &report.OrderURL})
 
-	if s.createAccount {
-		account, err = client.NewAccount(ctx, account)
-		if err != nil {
-			return fmt.Errorf("could not create ACME account: %w", err)
-		}
+	done = report.phase("account")
+	account, err := s.loadOrRegisterAccount(ctx, client.Client)
+	done()
+	if err != nil {
+		return classify(ExitACMEFailure, err)
+	}
+
+	keyRenewals, err := s.selectCertificateKey(current)
+	if err != nil {
+		return err
+	}
+
+	done = report.phase("order")
+	certs, err := client.ObtainCertificateForSANs(ctx, account, s.certPrivateKey, sans)
+	done()
+	if err != nil {
+		return classify(ExitACMEFailure, fmt.Errorf("could not get certs from ACME server: %w", err))
+	}
+
+	// a run asked to stop can still do so before the certificate is replaced,
+	// but not once that has started
+	if err = ctx.Err(); err != nil {
+		return err
 	}
 
-	fqdn, err := s.getLocalFQDN()
+	done = report.phase("install")
+	installed, backups, err := s.replaceActiveKey(certs, keyRenewals)
+	done()
 	if err != nil {
-		return fmt.Errorf("could not get local FQDN: %w", err)
+		return classify(ExitInstallFailure, err)
 	}
 
-	certs, err := client.ObtainCertificateForSANs(ctx, account, s.certPrivateKey, []string{fqdn})
+	report.CertificateURL = installed.URL
+	report.CertificateHash = certificateHash(&installed)
+	entry.NewHash, entry.KeyPath, entry.Backups = report.CertificateHash, installed.KeyPath, backups
+
+	done = report.phase("activate")
+	err = s.activation.activateOrRollBack(ctx, installed.PEMPath, backups)
+	done()
 	if err != nil {
-		return fmt.Errorf("could not get certs from ACME server: %w", err)
+		return classify(ExitInstallFailure, err)
 	}
 
-	return s.replaceActiveKey(certs)
+	// the certificate is in place, cleaning up after it must not fail the run
+	if s.pruner != nil {
+		if _, perr := s.pruner.prune(false); perr != nil {
+			slog.Warn("could not prune old certificates and backups", slog.Any("error", perr))
+		}
+	}
+
+	return nil
 }
 
-func (*ProvisionCommand) readOrCreatePrivateKey(apkPath string, curve elliptic.Curve, r io.Reader) (crypto.Signer, bool, error) {
-	apkBytes, err := os.ReadFile(apkPath)
+func (*ProvisionCommand) readOrCreatePrivateKey(keyPath string, kt keyType, r io.Reader) (crypto.Signer, bool, error) {
+	keyBytes, err := os.ReadFile(keyPath)
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return nil, false, fmt.Errorf("error loading private key: %w", err)
 	}
 
-	var pk *ecdsa.PrivateKey
-	switch apkBytes {
+	switch keyBytes {
 	case nil:
-		pk, err = ecdsa.GenerateKey(curve, r)
+		pk, err := generatePrivateKey(kt, r)
 		if err != nil {
-			return nil, false, fmt.Errorf("could not generate new private key for account: %w", err)
+			return nil, false, fmt.Errorf("could not generate new private key: %w", err)
 		}
 
-		x509Encoded, _ := x509.MarshalECPrivateKey(pk)
-		pemEncoded := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: x509Encoded})
+		pemEncoded, err := encodePrivateKey(pk)
+		if err != nil {
+			return nil, false, err
+		}
 
-		return pk, true, os.WriteFile(apkPath, pemEncoded, 0o400)
+		return pk, true, os.WriteFile(keyPath, pemEncoded, 0o400)
 	default:
-		block, _ := pem.Decode(apkBytes)
-		x509Encoded := block.Bytes
-		pk, err = x509.ParseECPrivateKey(x509Encoded)
-		return pk, false, err
+		pk, err := parsePrivateKey(keyBytes)
+		if err != nil {
+			return nil, false, fmt.Errorf("could not parse private key %s: %w", keyPath, err)
+		}
+		return pk, false, nil
+	}
+}
+
+// parseKeyRotation turns a --key-rotation value into the number of renewals a
+// key may be used for, where 0 means forever.
+func parseKeyRotation(policy string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(policy)) {
+	case "always":
+		return 1, nil
+	case "never":
+		return 0, nil
 	}
+
+	n, err := strconv.Atoi(policy)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("key rotation must be always, never or a positive number, got %q", policy)
+	}
+
+	return n, nil
+}
+
+// selectCertificateKey sets certPrivateKey for the next issuance according to
+// the rotation policy and returns how many certificates, including the next
+// one, will have been issued with it.
+func (s *ProvisionCommand) selectCertificateKey(current *acmeCertWithPath) (int, error) {
+	// before keys were stored per certificate, the same acme.cpk was used for
+	// every issuance
+	currentKeyPath, currentRenewals := filepath.Join(s.configDir, "acme.cpk"), 1
+	if current != nil && current.KeyPath != "" {
+		currentKeyPath, currentRenewals = current.KeyPath, current.KeyRenewals
+	}
+
+	reuse := s.keyRotationEvery == 0 || currentRenewals < s.keyRotationEvery
+	if reuse {
+		keyBytes, err := os.ReadFile(currentKeyPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return 0, fmt.Errorf("could not read current cert private key: %w", err)
+		}
+
+		if keyBytes != nil {
+			key, err := parsePrivateKey(keyBytes)
+			if err != nil {
+				return 0, fmt.Errorf("could not parse current cert private key %s: %w", currentKeyPath, err)
+			}
+
+			if kt, _ := privateKeyType(key); kt == s.keyType {
+				slog.Debug("reusing certificate key", slog.String("key-path", currentKeyPath), slog.Int("renewals", currentRenewals+1))
+				s.certPrivateKey = key
+				return currentRenewals + 1, nil
+			}
+
+			slog.Info("certificate key type changed, generating a new key", slog.String("configured", string(s.keyType)))
+		}
+	}
+
+	key, err := generatePrivateKey(s.keyType, rand.Reader)
+	if err != nil {
+		return 0, fmt.Errorf("could not generate cert private key: %w", err)
+	}
+
+	s.certPrivateKey = key
+	return 1, nil
 }
 
 type acmeCertWithPath struct {
 	acme.Certificate
-	PEMPath string `json:"pemPath"`
+	PEMPath     string  `json:"pemPath"`
+	KeyType     keyType `json:"keyType,omitempty"`
+	KeyPath     string  `json:"keyPath,omitempty"`
+	KeyRenewals int     `json:"keyRenewals,omitempty"`
+
+	RevokedAt        *time.Time `json:"revokedAt,omitempty"`
+	RevocationReason string     `json:"revocationReason,omitempty"`
+
+	// AddedCAs are the fingerprints of the CA certificates installing this
+	// certificate added to castore.pem
+	AddedCAs []string `json:"addedCAs,omitempty"`
 }
 
-func (s *ProvisionCommand) checkIfCertNeedsRenewal(context.Context) (bool, error) {
-	// if the original cert is not a symlink, then it's still the original cert
-	// and we need to replace it
-	certPath := filepath.Join(s.outputDir, certFile)
+// readActiveCertMetadata returns the metadata of the certificate rui.crt in
+// outputDir points to, or nil if rui.crt is missing or is not a symlink, i.e.
+// it is still the certificate ESXi generated.
+func readActiveCertMetadata(outputDir string) (*acmeCertWithPath, error) {
+	certPath := filepath.Join(outputDir, certFile)
 	fi, err := os.Lstat(certPath)
-	if err != nil && !errors.Is(err, fs.ErrNotExist) {
-		return false, err
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
 	}
 
 	if fi.Mode()&os.ModeSymlink == 0 {
-		return true, nil
+		return nil, nil
 	}
 
 	linkPath, err := os.Readlink(certPath)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+
+	c, err := readCertMetadata(strings.TrimSuffix(linkPath, ".pem") + ".json")
+	if err != nil {
+		return nil, err
+	}
+
+	if c.PEMPath != linkPath {
+		return nil, fmt.Errorf("expected cert path %s does not match stored path %s", linkPath, c.PEMPath)
 	}
 
-	jsonPath := strings.TrimSuffix(linkPath, ".pem") + ".json"
+	return c, nil
+}
+
+func readCertMetadata(jsonPath string) (*acmeCertWithPath, error) {
 	fp, err := os.Open(jsonPath)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	defer fp.Close()
 
 	var c acmeCertWithPath
 	if err = json.NewDecoder(fp).Decode(&c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func writeCertMetadata(jsonPath string, c acmeCertWithPath) error {
+	jfp, err := os.Create(jsonPath)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(jfp).Encode(c)
+	jfp.Close()
+	return err
+}
+
+func (s *ProvisionCommand) checkIfCertNeedsRenewal(ctx context.Context, ari renewalInfoGetter, c *acmeCertWithPath, sans []string) (bool, error) {
+	// if there is no metadata, it's still the original cert and we need to
+	// replace it
+	if c == nil {
+		return true, nil
+	}
+
+	if c.RevokedAt != nil {
+		slog.Info("the installed certificate was revoked, reissuing", slog.String("pem-path", c.PEMPath))
+		return true, nil
+	}
+
+	leaf, err := readLeafCertificate(c.PEMPath)
+	if err != nil {
 		return false, err
 	}
 
-	if c.PEMPath != linkPath {
-		return false, fmt.Errorf("expected cert path %s does not match stored path %s", linkPath, c.PEMPath)
+	if !sameSANs(leaf, sans) {
+		slog.Info("configured identifiers differ from the installed certificate, reissuing",
+			slog.Any("configured", sans), slog.Any("installed", installedSANs(leaf)))
+		return true, nil
 	}
 
-	if c.RenewalInfo == nil {
-		return false, errors.New("cert info missing renewal info")
+	installedKeyType := c.KeyType
+	if installedKeyType == "" {
+		// metadata written before key types were recorded
+		installedKeyType, _ = publicKeyType(leaf.PublicKey)
 	}
 
-	windowStart := c.RenewalInfo.SuggestedWindow.Start.Add(-time.Nanosecond)
-	windowEnd := c.RenewalInfo.SuggestedWindow.End.Add(time.Hour)
+	if installedKeyType != s.keyType {
+		slog.Info("configured key type differs from the installed certificate, reissuing",
+			slog.String("configured", string(s.keyType)), slog.String("installed", string(installedKeyType)))
+		return true, nil
+	}
 
-	now := time.Now()
-	return now.After(windowStart) && now.Before(windowEnd), nil
+	return s.renewalDue(ctx, ari, c, leaf, time.Now()), nil
 }
 
-func (s *ProvisionCommand) replaceActiveKey(certs []acme.Certificate) error {
+// replaceActiveKey stores certs and installs the first one. It returns the
+// installed certificate and what it replaced.
+func (s *ProvisionCommand) replaceActiveKey(certs []acme.Certificate, keyRenewals int) (acmeCertWithPath, []tlsFileBackup, error) {
 	// there should only be one here, but ¯\_(ツ)_/¯
-	chainPEM := &bytes.Buffer{}
+	var castoreContents []byte
 	augmentedCerts := make([]acmeCertWithPath, 0, len(certs))
 	for _, cert := range certs {
 		var certsDER [][]byte
@@ -234,17 +528,19 @@ func (s *ProvisionCommand) replaceActiveKey(certs []acme.Certificate) error {
 		sum := sha256.Sum256(cert.ChainPEM)
 		filename := hex.EncodeToString(sum[:])
 
+		var chain []*x509.Certificate
 		chainBytes := cert.ChainPEM
 		for {
 			var block *pem.Block
 			block, chainBytes = pem.Decode(chainBytes)
 			if block != nil && block.Type == "CERTIFICATE" {
-				_, err := x509.ParseCertificate(block.Bytes)
+				parsed, err := x509.ParseCertificate(block.Bytes)
 				if err != nil {
-					return err
+					return acmeCertWithPath{}, nil, err
 				}
 
 				certsDER = append(certsDER, block.Bytes)
+				chain = append(chain, parsed)
 				continue
 			}
 
@@ -254,52 +550,138 @@ func (s *ProvisionCommand) replaceActiveKey(certs []acme.Certificate) error {
 		if len(certsDER) > 0 {
 			certFP, err := os.Create(filepath.Join(s.certsDir, filename+".pem"))
 			if err != nil {
-				return err
+				return acmeCertWithPath{}, nil, err
 			}
 			b := &pem.Block{Bytes: certsDER[0], Type: "CERTIFICATE"}
 
 			err = pem.Encode(certFP, b)
 			certFP.Close()
 			if err != nil {
-				return err
+				return acmeCertWithPath{}, nil, err
 			}
+		}
 
-			for _, der := range certsDER[1:] {
-				block := &pem.Block{Bytes: der, Type: "CERTIFICATE"}
-				if err = pem.Encode(chainPEM, block); err != nil {
-					return err
-				}
-				fmt.Fprintln(chainPEM)
-			}
+		// every issuance gets its own copy of the key, even when it is reused,
+		// so rui.key can always point next to the cert it belongs to
+		keyPEM, err := encodePrivateKey(s.certPrivateKey)
+		if err != nil {
+			return acmeCertWithPath{}, nil, err
+		}
+
+		keyPath := filepath.Join(s.certsDir, filename+".key")
+		if err = os.WriteFile(keyPath, keyPEM, 0o400); err != nil {
+			return acmeCertWithPath{}, nil, err
 		}
 
 		augmentedCert := acmeCertWithPath{
 			Certificate: cert,
 			PEMPath:     filepath.Join(s.certsDir, filename+".pem"),
+			KeyType:     s.keyType,
+			KeyPath:     keyPath,
+			KeyRenewals: keyRenewals,
 		}
 
-		jsonFilename := filepath.Join(s.certsDir, filename+".json")
-		jfp, err := os.Create(jsonFilename)
-		if err != nil {
-			return err
+		// only the first chain is installed, the CAs of alternate chains do
+		// not belong in castore.pem
+		if len(augmentedCerts) == 0 && len(chain) > 0 {
+			castoreContents, augmentedCert.AddedCAs, err = s.updateCAStore(chain[1:])
+			if err != nil {
+				return acmeCertWithPath{}, nil, fmt.Errorf("could not update %s: %w", castore, err)
+			}
 		}
-		err = json.NewEncoder(jfp).Encode(augmentedCert)
-		jfp.Close()
-		if err != nil {
-			return err
+
+		if err = writeCertMetadata(filepath.Join(s.certsDir, filename+".json"), augmentedCert); err != nil {
+			return acmeCertWithPath{}, nil, err
 		}
 
 		augmentedCerts = append(augmentedCerts, augmentedCert)
 	}
 
 	if len(augmentedCerts) == 0 {
-		return errors.New("no certificates were generated")
+		return acmeCertWithPath{}, nil, errors.New("no certificates were generated")
 	}
 
-	return s.backupAndResetActiveTLSFiles(augmentedCerts[0], chainPEM.Bytes())
+	backups, err := s.backupAndResetActiveTLSFiles(augmentedCerts[0], castoreContents)
+	return augmentedCerts[0], backups, err
 }
 
-func (*ProvisionCommand) getLocalFQDN() (string, error) {
+// certificateSANs returns the deduplicated identifiers to request: the host
+// FQDN unless excluded, any extra DNS names, then any IP addresses.
+func (s *ProvisionCommand) certificateSANs() ([]string, error) {
+	var names []string
+	if s.includeHostFQDN {
+		fqdn, err := s.localFQDN()
+		if err != nil {
+			return nil, fmt.Errorf("could not get local FQDN: %w", err)
+		}
+		names = append(names, fqdn)
+	}
+
+	names = append(names, s.domains...)
+
+	sans := make([]string, 0, len(names)+len(s.ipAddresses))
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+		if name != "" && !slices.Contains(sans, name) {
+			sans = append(sans, name)
+		}
+	}
+
+	for _, ip := range s.ipAddresses {
+		if !slices.Contains(sans, ip) {
+			sans = append(sans, ip)
+		}
+	}
+
+	return sans, nil
+}
+
+// installedSANs returns the DNS names and IP addresses in cert in the same
+// normalized form used for configured identifiers.
+func installedSANs(cert *x509.Certificate) []string {
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.IPAddresses))
+	for _, name := range cert.DNSNames {
+		sans = append(sans, strings.ToLower(name))
+	}
+
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+
+	return sans
+}
+
+func sameSANs(cert *x509.Certificate, sans []string) bool {
+	installed := installedSANs(cert)
+	slices.Sort(installed)
+
+	configured := slices.Clone(sans)
+	slices.Sort(configured)
+
+	return slices.Equal(installed, configured)
+}
+
+// readLeafCertificate returns the first certificate in the PEM file at path.
+func readLeafCertificate(path string) (*x509.Certificate, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate found in %s", path)
+		}
+
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+func getLocalFQDN() (string, error) {
 	cmd := exec.Command("/bin/hostname", "-f")
 
 	out := &strings.Builder{}
@@ -309,82 +691,80 @@ func (*ProvisionCommand) getLocalFQDN() (string, error) {
 	return strings.TrimSpace(out.String()), err
 }
 
-func (s *ProvisionCommand) backupAndResetActiveTLSFiles(cert acmeCertWithPath, caChain []byte) error {
-	activeKeyFile := filepath.Join(s.outputDir, privateKeyFile)
-	activeCertFile := filepath.Join(s.outputDir, certFile)
-	castoreFile := filepath.Join(s.outputDir, castore)
-
-	if err := s.backupAndReplace(activeKeyFile, filepath.Join(s.configDir, "acme.cpk")); err != nil {
-		return err
-	}
+// tlsFileBackup records what a file in the output directory was before it was
+// replaced, so it can be put back. If neither field is set, the file did not
+// exist.
+type tlsFileBackup struct {
+	Path       string `json:"path"`
+	LinkTarget string `json:"linkTarget,omitempty"`
+	BackupPath string `json:"backupPath,omitempty"`
+}
 
-	if err := s.backupAndReplace(activeCertFile, cert.PEMPath); err != nil {
-		return err
+// backupAndResetActiveTLSFiles points rui.key and rui.crt at cert and, unless
+// it is nil, replaces castore.pem with castoreContents, all in one swap.
+func (s *ProvisionCommand) backupAndResetActiveTLSFiles(cert acmeCertWithPath, castoreContents []byte) ([]tlsFileBackup, error) {
+	changes := []tlsFileChange{
+		{Path: filepath.Join(s.outputDir, privateKeyFile), LinkTarget: cert.KeyPath},
+		{Path: filepath.Join(s.outputDir, certFile), LinkTarget: cert.PEMPath},
 	}
 
-	cas, err := os.OpenFile(castoreFile, os.O_CREATE|os.O_APPEND, 0o644)
-	if err != nil {
-		return err
+	if castoreContents != nil {
+		changes = append(changes, tlsFileChange{Path: filepath.Join(s.outputDir, castore), Contents: castoreContents})
 	}
-	defer cas.Close()
 
-	fmt.Fprintln(cas)
-	cas.Write(caChain)
-	return nil
+	return swapTLSFiles(s.runDir, changes)
 }
 
-func (s *ProvisionCommand) backupAndReplace(origFile string, newFile string) error {
+// backupFile records where origFile links to, or copies it next to itself if
+// it is a regular file.
+func backupFile(origFile string) (tlsFileBackup, error) {
+	backup := tlsFileBackup{Path: origFile}
 	fi, err := os.Lstat(origFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return backup, nil
+	}
+
 	if err != nil {
-		return err
+		return backup, err
 	}
 
 	if fi.IsDir() {
-		return fmt.Errorf("%s is a dir", origFile)
+		return backup, fmt.Errorf("%s is a dir", origFile)
 	}
 
-	backupFilePath := fmt.Sprintf("%s.%d.bak", origFile, time.Now().UnixNano())
-	if fi.Mode()&os.ModeSymlink != os.ModeSymlink {
-		src, berr := os.Open(origFile)
-		if berr != nil {
-			return berr
-		}
-		defer src.Close()
+	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		backup.LinkTarget, err = os.Readlink(origFile)
+		return backup, err
+	}
 
-		dst, berr := os.OpenFile(backupFilePath, os.O_CREATE|os.O_EXCL, fi.Mode()&os.ModePerm)
-		if berr != nil {
-			return berr
-		}
-		defer dst.Close()
-		_, berr = io.Copy(dst, src)
-		if berr != nil {
-			return berr
-		}
+	backupFilePath := fmt.Sprintf("%s.%d.bak", origFile, time.Now().UnixNano())
+	if err = copyFile(origFile, backupFilePath, fi.Mode()&os.ModePerm); err != nil {
+		return backup, err
 	}
 
-	if err = os.Remove(origFile); err != nil {
+	backup.BackupPath = backupFilePath
+	return backup, nil
+}
+
+func copyFile(srcPath, dstPath string, perm os.FileMode) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
 		return err
 	}
+	defer src.Close()
 
-	if err = os.Symlink(newFile, origFile); err != nil {
-		s.restoreBackup(origFile, backupFilePath)
+	dst, err := os.OpenFile(dstPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func (s *ProvisionCommand) restoreBackup(origFile, backupFile string) {
-	src, e := os.Open(backupFile)
-	if e != nil {
-		return
+	if _, err = io.Copy(dst, src); err == nil {
+		err = dst.Sync()
 	}
-	defer src.Close()
-	dst, e := os.Create(origFile)
-	if e != nil {
-		return
+
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
 	}
-	defer dst.Close()
 
-	io.Copy(dst, src)
+	return err
 }
@@ -0,0 +1,178 @@
+package app
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+	. "github.com/onsi/gomega"
+)
+
+func TestCertificateSANs(t *testing.T) {
+	hostname := func() (string, error) { return "esxi01.example.com", nil }
+
+	for _, tc := range []struct {
+		name     string
+		cmd      ProvisionCommand
+		expected []string
+	}{
+		{
+			name:     "host FQDN only",
+			cmd:      ProvisionCommand{includeHostFQDN: true, localFQDN: hostname},
+			expected: []string{"esxi01.example.com"},
+		},
+		{
+			name:     "extra names after the host FQDN",
+			cmd:      ProvisionCommand{includeHostFQDN: true, localFQDN: hostname, domains: []string{"esxi01.mgmt.example.com", "vcenter.example.com"}},
+			expected: []string{"esxi01.example.com", "esxi01.mgmt.example.com", "vcenter.example.com"},
+		},
+		{
+			name:     "IP addresses after the names",
+			cmd:      ProvisionCommand{localFQDN: hostname, domains: []string{"esxi01.example.com"}, ipAddresses: []string{"192.0.2.10", "2001:db8::10"}},
+			expected: []string{"esxi01.example.com", "192.0.2.10", "2001:db8::10"},
+		},
+		{
+			name:     "IP addresses only",
+			cmd:      ProvisionCommand{ipAddresses: []string{"192.0.2.10"}},
+			expected: []string{"192.0.2.10"},
+		},
+		{
+			name:     "names are normalized and deduplicated",
+			cmd:      ProvisionCommand{includeHostFQDN: true, localFQDN: hostname, domains: []string{" ESXi01.Example.com. ", "", "other.example.com", "other.example.com"}, ipAddresses: []string{"192.0.2.10", "192.0.2.10"}},
+			expected: []string{"esxi01.example.com", "other.example.com", "192.0.2.10"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			RegisterTestingT(t)
+
+			Expect(tc.cmd.certificateSANs()).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestCertificateSANsHostnameFailure(t *testing.T) {
+	RegisterTestingT(t)
+
+	s := &ProvisionCommand{includeHostFQDN: true, localFQDN: func() (string, error) { return "", errors.New("no hostname") }}
+	_, err := s.certificateSANs()
+	Expect(err).To(MatchError(ContainSubstring("no hostname")))
+}
+
+func TestSameSANs(t *testing.T) {
+	cert := &x509.Certificate{
+		DNSNames:    []string{"ESXi01.example.com", "vcenter.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("192.0.2.10")},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		sans     []string
+		expected bool
+	}{
+		{name: "same order", sans: []string{"esxi01.example.com", "vcenter.example.com", "192.0.2.10"}, expected: true},
+		{name: "any order", sans: []string{"192.0.2.10", "vcenter.example.com", "esxi01.example.com"}, expected: true},
+		{name: "name added", sans: []string{"esxi01.example.com", "vcenter.example.com", "192.0.2.10", "new.example.com"}},
+		{name: "name removed", sans: []string{"esxi01.example.com", "192.0.2.10"}},
+		{name: "IP address changed", sans: []string{"esxi01.example.com", "vcenter.example.com", "192.0.2.11"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			RegisterTestingT(t)
+
+			Expect(sameSANs(cert, tc.sans)).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestCertificateReissuedWhenSANsChange(t *testing.T) {
+	RegisterTestingT(t)
+
+	// issued yesterday, so it is not due by its lifetime
+	now := time.Now()
+	meta := writeTestCertificate(t.TempDir(), "aa11", now.Add(-24*time.Hour), now.Add(89*24*time.Hour))
+	s := &ProvisionCommand{keyType: keyTypeEC256, renewBeforeDays: 30, renewPercent: 33}
+	ari := &fakeRenewalInfo{err: errors.New("ARI is not supported")}
+
+	Expect(s.checkIfCertNeedsRenewal(context.Background(), ari, &meta, []string{"host.example"})).To(BeFalse())
+	Expect(s.checkIfCertNeedsRenewal(context.Background(), ari, &meta, []string{"host.example", "other.example"})).To(BeTrue())
+	Expect(s.checkIfCertNeedsRenewal(context.Background(), ari, &meta, []string{"other.example"})).To(BeTrue())
+	Expect(s.checkIfCertNeedsRenewal(context.Background(), ari, &meta, []string{"host.example", "192.0.2.10"})).To(BeTrue())
+}
+
+// parseTestCommandLine parses args after the global options every command
+// needs, the way Run does, with baseDir as the installation directory.
+func parseTestCommandLine(baseDir string, args ...string) (*kong.Context, *commandlineArgs, error) {
+	targetDir := filepath.Join(baseDir, "ssl")
+	Expect(os.MkdirAll(filepath.Join(baseDir, "plugins"), 0o755)).To(Succeed())
+	Expect(os.MkdirAll(targetDir, 0o755)).To(Succeed())
+
+	var parsed commandlineArgs
+	opts := &StartOptions{Stdout: io.Discard, Stderr: io.Discard, LogWriter: os.Stderr}
+	k, err := newParser(context.Background(), opts, baseDir, &parsed)
+	Expect(err).NotTo(HaveOccurred())
+
+	kctx, err := k.Parse(append([]string{
+		"--account-email", "admin@example.com", "--provider", "fake",
+		"--target-directory", targetDir, "--no-host-fqdn", "--domain", "esxi01.example.com",
+	}, args...))
+	return kctx, &parsed, err
+}
+
+func TestIPAddressesRejected(t *testing.T) {
+	RegisterTestingT(t)
+
+	for _, command := range []string{"provision", "daemon"} {
+		_, _, err := parseTestCommandLine(t.TempDir(), "--ip-address", "192.0.2.10", command)
+		Expect(err).To(MatchError(ContainSubstring("dns-01")), command)
+
+		var ce *classifiedError
+		Expect(errors.As(err, &ce)).To(BeTrue(), command)
+		Expect(ce.ExitCode()).To(Equal(ExitUsage), command)
+	}
+
+	_, _, err := parseTestCommandLine(t.TempDir(), "--ip-address", "not-an-ip", "provision")
+	Expect(err).To(MatchError(ContainSubstring("not a valid IP address")))
+}
+
+func TestExternalAccountBinding(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		expected string
+		err      string
+	}{
+		{name: "not used"},
+		{name: "key ID and key", args: []string{"--eab-kid", "kid-1", "--eab-hmac-key", "c2VjcmV0LWtleQ"}, expected: "c2VjcmV0LWtleQ"},
+		{name: "URL alphabet", args: []string{"--eab-kid", "kid-1", "--eab-hmac-key", "ab-_cd"}, expected: "ab-_cd"},
+		{name: "padding is removed", args: []string{"--eab-kid", "kid-1", "--eab-hmac-key", "c2VjcmV0LWtleQ=="}, expected: "c2VjcmV0LWtleQ"},
+		{name: "key ID only", args: []string{"--eab-kid", "kid-1"}, err: "must be used together"},
+		{name: "key only", args: []string{"--eab-hmac-key", "c2VjcmV0LWtleQ"}, err: "must be used together"},
+		{name: "key not base64url", args: []string{"--eab-kid", "kid-1", "--eab-hmac-key", "c2VjcmV0+a2V5/"}, err: "base64url"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			RegisterTestingT(t)
+
+			_, parsed, err := parseTestCommandLine(t.TempDir(), append([]string{"provision"}, tc.args...)...)
+			if tc.err != "" {
+				Expect(err).To(MatchError(ContainSubstring(tc.err)))
+				return
+			}
+
+			Expect(err).NotTo(HaveOccurred())
+			if tc.expected == "" {
+				Expect(parsed.Provision.eab).To(BeNil())
+				return
+			}
+
+			Expect(parsed.Provision.eab).NotTo(BeNil())
+			Expect(parsed.Provision.eab.KeyID).To(Equal("kid-1"))
+			Expect(parsed.Provision.eab.MACKey).To(Equal(tc.expected))
+		})
+	}
+}
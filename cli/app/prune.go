@@ -0,0 +1,265 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kong"
+)
+
+type PruneCommand struct {
+	DryRun bool   `help:"Only list what would be removed"`
+	Output string `short:"o" default:"text" enum:"text,json" help:"Output format, text or json"`
+	Wait   bool   `env:"LE_ESXI_WAIT" help:"Wait for a run in progress to finish instead of failing"`
+
+	pruner pruner
+}
+
+// prunedFile is a file the retention policy removes.
+type prunedFile struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// pruner enforces the retention policy: the newest stored certificates and
+// backups are kept, along with the active certificate and the backup of the
+// one ESXi generated, which are never removed.
+type pruner struct {
+	certsDir         string
+	configDir        string
+	outputDir        string
+	runDir           string
+	historyPath      string
+	keepCertificates int
+	keepBackups      int
+}
+
+func newPruner(opts RunOptions) pruner {
+	return pruner{
+		certsDir:         filepath.Join(opts.BaseDir, "certs"),
+		configDir:        filepath.Join(opts.BaseDir, ".config"),
+		outputDir:        opts.TargetDirectory,
+		runDir:           filepath.Join(opts.BaseDir, "run"),
+		historyPath:      filepath.Join(opts.BaseDir, historyFile),
+		keepCertificates: opts.KeepCertificates,
+		keepBackups:      opts.KeepBackups,
+	}
+}
+
+func (c *PruneCommand) AfterApply(opts RunOptions) error {
+	c.pruner = newPruner(opts)
+	return nil
+}
+
+func (c *PruneCommand) Run(ctx context.Context, kctx *kong.Context) error {
+	// a provision run must not install a certificate this is removing
+	if !c.DryRun {
+		lock, err := acquireRunLock(ctx, c.pruner.runDir, "prune", c.Wait)
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+
+	pruned, err := c.pruner.prune(c.DryRun)
+	if perr := c.print(kctx.Stdout, pruned); err == nil {
+		err = perr
+	}
+
+	return err
+}
+
+// prune removes what the retention policy does not keep, and returns what it
+// removed, or would remove if dryRun is set.
+func (p pruner) prune(dryRun bool) ([]prunedFile, error) {
+	// a swap in progress, or one still to be recovered, needs its backups
+	if _, err := os.Stat(filepath.Join(p.runDir, swapJournalFile)); err == nil {
+		return nil, errors.New("a certificate swap is in progress, not pruning")
+	}
+
+	certs, err := p.oldCertificates()
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := append(certs, p.oldBackups()...)
+	if dryRun {
+		return pruned, nil
+	}
+
+	if err = p.keepManagedCAs(pruned); err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	removed := make([]prunedFile, 0, len(pruned))
+	for _, f := range pruned {
+		if err = os.Remove(f.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+			continue
+		}
+
+		slog.Debug("removed file", slog.String("path", f.Path), slog.String("reason", f.Reason))
+		removed = append(removed, f)
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+// oldCertificates returns the files of the stored certificates beyond the
+// newest keepCertificates, except the active one.
+func (p pruner) oldCertificates() ([]prunedFile, error) {
+	if p.keepCertificates <= 0 {
+		return nil, nil
+	}
+
+	active, err := readActiveCertMetadata(p.outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	metadataFiles, err := filepath.Glob(filepath.Join(p.certsDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	type storedCert struct {
+		base     string
+		issuedAt time.Time
+	}
+
+	var stored []storedCert
+	for _, jsonPath := range metadataFiles {
+		base := strings.TrimSuffix(jsonPath, ".json")
+		if active != nil && active.PEMPath == base+".pem" {
+			continue
+		}
+
+		// certificates that cannot be read sort as the oldest
+		var issuedAt time.Time
+		if leaf, err := readLeafCertificate(base + ".pem"); err == nil {
+			issuedAt = leaf.NotBefore
+		}
+		stored = append(stored, storedCert{base: base, issuedAt: issuedAt})
+	}
+
+	slices.SortFunc(stored, func(a, b storedCert) int {
+		return b.issuedAt.Compare(a.issuedAt)
+	})
+
+	// the active certificate counts towards the ones kept
+	keep := p.keepCertificates
+	if active != nil {
+		keep--
+	}
+
+	var pruned []prunedFile
+	for _, cert := range stored[min(keep, len(stored)):] {
+		for _, ext := range []string{".pem", ".key", ".json"} {
+			if _, err := os.Stat(cert.base + ext); err == nil {
+				pruned = append(pruned, prunedFile{Path: cert.base + ext, Reason: "old certificate"})
+			}
+		}
+	}
+
+	return pruned, nil
+}
+
+// keepManagedCAs records the CAs added for the pruned certificates, so
+// pruning castore.pem can still tell they were added by this tool once the
+// metadata is gone.
+func (p pruner) keepManagedCAs(pruned []prunedFile) error {
+	var added []string
+	for _, f := range pruned {
+		if filepath.Dir(f.Path) != p.certsDir || filepath.Ext(f.Path) != ".json" {
+			continue
+		}
+
+		meta, err := readCertMetadata(f.Path)
+		if err != nil {
+			slog.Warn("skipping unreadable certificate metadata", slog.String("path", f.Path), slog.Any("error", err))
+			continue
+		}
+		added = append(added, meta.AddedCAs...)
+	}
+
+	if len(added) == 0 {
+		return nil
+	}
+
+	if err := recordManagedCAs(filepath.Join(p.configDir, managedCAsFile), added); err != nil {
+		return fmt.Errorf("could not record the CAs added for pruned certificates: %w", err)
+	}
+
+	return nil
+}
+
+// oldBackups returns the backups in outputDir beyond the newest keepBackups
+// of each file, except the backup of the certificate ESXi generated.
+func (p pruner) oldBackups() []prunedFile {
+	if p.keepBackups <= 0 {
+		return nil
+	}
+
+	var protected []string
+	if original, ok := findOriginalCertificate(p.outputDir, p.historyPath); ok {
+		protected = append(protected, original.CertPath, original.KeyPath)
+	}
+
+	var pruned []prunedFile
+	for _, name := range []string{privateKeyFile, certFile, castore} {
+		backups, _ := filepath.Glob(filepath.Join(p.outputDir, name+".*.bak"))
+		backups = slices.DeleteFunc(backups, func(path string) bool {
+			return slices.Contains(protected, path)
+		})
+
+		// the names end in a nanosecond timestamp, so they sort by age
+		slices.Sort(backups)
+		slices.Reverse(backups)
+		for _, path := range backups[min(p.keepBackups, len(backups)):] {
+			pruned = append(pruned, prunedFile{Path: path, Reason: "old backup"})
+		}
+	}
+
+	return pruned
+}
+
+func (c *PruneCommand) print(w io.Writer, pruned []prunedFile) error {
+	if c.Output == "json" {
+		if pruned == nil {
+			pruned = []prunedFile{}
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(pruned)
+	}
+
+	if len(pruned) == 0 {
+		_, err := fmt.Fprintln(w, "nothing to prune")
+		return err
+	}
+
+	verb := "removed"
+	if c.DryRun {
+		verb = "would remove"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, f := range pruned {
+		fmt.Fprintf(tw, "%s\t%s\t(%s)\n", verb, f.Path, f.Reason)
+	}
+
+	return tw.Flush()
+}
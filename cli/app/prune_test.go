@@ -0,0 +1,96 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestPrune(t *testing.T) {
+	RegisterTestingT(t)
+
+	baseDir, outputDir, vmwareDir := t.TempDir(), t.TempDir(), t.TempDir()
+	certsDir := filepath.Join(baseDir, "certs")
+	Expect(os.MkdirAll(certsDir, 0o755)).To(Succeed())
+
+	now := time.Now()
+	original := writeTestCertificate(vmwareDir, "vmware", now.Add(-time.Hour), now.Add(365*24*time.Hour))
+	active := writeTestCertificate(certsDir, "aa11", now.Add(-90*24*time.Hour), now.Add(time.Hour))
+	writeTestCertificate(certsDir, "bb22", now.Add(-60*24*time.Hour), now.Add(30*24*time.Hour))
+	writeTestCertificate(certsDir, "cc33", now.Add(-30*24*time.Hour), now.Add(60*24*time.Hour))
+	writeTestCertificate(certsDir, "dd44", now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	writeVMwareFiles(outputDir, original)
+
+	p := &ProvisionCommand{outputDir: outputDir, runDir: filepath.Join(baseDir, "run")}
+	_, err := p.backupAndResetActiveTLSFiles(active, nil)
+	Expect(err).NotTo(HaveOccurred())
+
+	// backups of later runs, newer than the one of the original
+	var newest string
+	for i := range 3 {
+		newest = filepath.Join(outputDir, fmt.Sprintf("%s.%d.bak", certFile, now.Add(time.Duration(i+1)*time.Hour).UnixNano()))
+		Expect(os.WriteFile(newest, []byte("not the original"), 0o600)).To(Succeed())
+	}
+	originalBackup, ok := findOriginalCertificate(outputDir, filepath.Join(baseDir, historyFile))
+	Expect(ok).To(BeTrue())
+
+	c := &PruneCommand{DryRun: true}
+	Expect(c.AfterApply(RunOptions{BaseDir: baseDir, TargetDirectory: outputDir, KeepCertificates: 2, KeepBackups: 1})).To(Succeed())
+
+	planned, err := c.pruner.prune(true)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(planned).NotTo(BeEmpty())
+	Expect(filepath.Join(certsDir, "bb22.pem")).To(BeAnExistingFile())
+
+	// not while another run holds the lock
+	lock, err := acquireRunLock(context.Background(), filepath.Join(baseDir, "run"), "provision", false)
+	Expect(err).NotTo(HaveOccurred())
+	c.DryRun = false
+	err = c.Run(context.Background(), nil)
+	Expect(exitCode(err)).To(Equal(ExitLockHeld))
+	Expect(filepath.Join(certsDir, "bb22.pem")).To(BeAnExistingFile())
+	lock.release()
+
+	removed, err := c.pruner.prune(false)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(removed).To(Equal(planned))
+
+	// the active certificate and the newest other one are kept
+	remaining, err := filepath.Glob(filepath.Join(certsDir, "*"))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(remaining).To(ConsistOf(
+		active.PEMPath, active.KeyPath, filepath.Join(certsDir, "aa11.json"),
+		filepath.Join(certsDir, "dd44.pem"), filepath.Join(certsDir, "dd44.key"), filepath.Join(certsDir, "dd44.json"),
+	))
+
+	// the newest backup and the original are kept
+	backups, err := filepath.Glob(filepath.Join(outputDir, certFile+".*.bak"))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(backups).To(ConsistOf(newest, originalBackup.CertPath))
+	Expect(originalBackup.KeyPath).To(BeAnExistingFile())
+
+	// a swap that has not finished still needs its backups
+	Expect(os.WriteFile(filepath.Join(baseDir, "run", swapJournalFile), []byte("{}"), 0o600)).To(Succeed())
+	_, err = c.pruner.prune(false)
+	Expect(err).To(MatchError(ContainSubstring("in progress")))
+}
+
+func TestPruneZeroKeepsEverything(t *testing.T) {
+	RegisterTestingT(t)
+
+	baseDir, outputDir := t.TempDir(), t.TempDir()
+	certsDir := filepath.Join(baseDir, "certs")
+	Expect(os.MkdirAll(certsDir, 0o755)).To(Succeed())
+
+	now := time.Now()
+	writeTestCertificate(certsDir, "aa11", now.Add(-90*24*time.Hour), now.Add(time.Hour))
+	Expect(os.WriteFile(filepath.Join(outputDir, certFile+".1.bak"), nil, 0o600)).To(Succeed())
+
+	p := newPruner(RunOptions{BaseDir: baseDir, TargetDirectory: outputDir})
+	Expect(p.prune(false)).To(BeEmpty())
+}
@@ -0,0 +1,115 @@
+package app
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+// defaultARIPollInterval is how long renewal info is trusted when the CA does
+// not send a Retry-After header.
+const defaultARIPollInterval = 6 * time.Hour
+
+type renewalInfoGetter interface {
+	GetRenewalInfo(ctx context.Context, leafCert *x509.Certificate) (acme.RenewalInfo, error)
+}
+
+// renewalDue decides whether the installed certificate should be renewed at
+// now. ACME Renewal Information (RFC 9773) is preferred: it is refreshed once
+// the stored copy's Retry-After has passed, and the certificate is due from
+// the randomly selected time inside the suggested window onwards, including
+// after the window has closed. Without ARI, the certificate is due once less
+// than --renew-before-days or --renew-remaining-percent of its lifetime is
+// left.
+func (s *ProvisionCommand) renewalDue(ctx context.Context, ari renewalInfoGetter, c *acmeCertWithPath, leaf *x509.Certificate, now time.Time) bool {
+	if !now.Before(leaf.NotAfter) {
+		slog.Warn("the installed certificate has expired", slog.Time("not-after", leaf.NotAfter))
+		return true
+	}
+
+	info := s.refreshRenewalInfo(ctx, ari, c, leaf, now)
+	if info.HasWindow() {
+		selected := ariRenewalTime(info)
+		due := !now.Before(selected)
+		slog.Debug("checked renewal info", slog.Time("window-start", info.SuggestedWindow.Start),
+			slog.Time("window-end", info.SuggestedWindow.End), slog.Time("selected-time", selected), slog.Bool("due", due))
+		return due
+	}
+
+	renewAt := fallbackRenewalTime(leaf, s.renewBeforeDays, s.renewPercent)
+	due := now.After(renewAt)
+	slog.Debug("checked remaining lifetime", slog.Time("renew-at", renewAt), slog.Time("not-after", leaf.NotAfter), slog.Bool("due", due))
+	return due
+}
+
+// ariRenewalTime is when a certificate with renewal info becomes due: the
+// time selected within the window, or the window start if none was.
+func ariRenewalTime(info acme.RenewalInfo) time.Time {
+	if info.SelectedTime.IsZero() {
+		return info.SuggestedWindow.Start
+	}
+
+	return info.SelectedTime
+}
+
+// fallbackRenewalTime is when a certificate without renewal info becomes due:
+// once fewer than beforeDays days or percent of its lifetime remain,
+// whichever comes first.
+func fallbackRenewalTime(leaf *x509.Certificate, beforeDays, percent int) time.Time {
+	before := leaf.NotAfter.Sub(leaf.NotBefore) * time.Duration(percent) / 100
+	if days := time.Duration(beforeDays) * 24 * time.Hour; days > before {
+		before = days
+	}
+
+	return leaf.NotAfter.Add(-before)
+}
+
+// refreshRenewalInfo returns the renewal info to use for c, fetching it from
+// the CA unless the stored copy is still within its Retry-After period. Fresh
+// info is saved with the certificate metadata. An empty RenewalInfo means ARI
+// is not available.
+func (s *ProvisionCommand) refreshRenewalInfo(ctx context.Context, ari renewalInfoGetter, c *acmeCertWithPath, leaf *x509.Certificate, now time.Time) acme.RenewalInfo {
+	var stored acme.RenewalInfo
+	if c.RenewalInfo != nil {
+		stored = *c.RenewalInfo
+	}
+
+	if stored.HasWindow() && stored.RetryAfter != nil && now.Before(*stored.RetryAfter) {
+		return stored
+	}
+
+	fresh, err := ari.GetRenewalInfo(ctx, leaf)
+	if err != nil {
+		if errors.Is(err, acme.ErrUnsupported) {
+			slog.Debug("the CA does not support renewal info", slog.Any("error", err))
+		} else {
+			slog.Warn("could not get renewal info, falling back to the certificate lifetime", slog.Any("error", err))
+		}
+
+		// the stored window is still the CA's last word, even if stale
+		return stored
+	}
+
+	// keep the previously selected time while the window is unchanged, so it
+	// does not move around every time this runs
+	if stored.HasWindow() && fresh.SameWindow(stored) && !stored.SelectedTime.IsZero() {
+		fresh.SelectedTime = stored.SelectedTime
+	}
+
+	if fresh.RetryAfter == nil {
+		retryAfter := now.Add(defaultARIPollInterval)
+		fresh.RetryAfter = &retryAfter
+	}
+
+	c.RenewalInfo = &fresh
+	if err = writeCertMetadata(strings.TrimSuffix(c.PEMPath, ".pem")+".json", *c); err != nil {
+		slog.Warn("could not save renewal info", slog.Any("error", err))
+	}
+
+	return fresh
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+	. "github.com/onsi/gomega"
+)
+
+type fakeRenewalInfo struct {
+	info  acme.RenewalInfo
+	err   error
+	calls int
+}
+
+func (f *fakeRenewalInfo) GetRenewalInfo(context.Context, *x509.Certificate) (acme.RenewalInfo, error) {
+	f.calls++
+	return f.info, f.err
+}
+
+func renewalWindow(start, end time.Time, selected time.Time) acme.RenewalInfo {
+	var info acme.RenewalInfo
+	info.SuggestedWindow.Start = start
+	info.SuggestedWindow.End = end
+	info.SelectedTime = selected
+	return info
+}
+
+func TestRenewalDueWithRenewalInfo(t *testing.T) {
+	RegisterTestingT(t)
+
+	certsDir := t.TempDir()
+	issued := time.Now().Add(-60 * 24 * time.Hour)
+	meta := writeTestCertificate(certsDir, "aa11", issued, issued.Add(90*24*time.Hour))
+	leaf, err := readLeafCertificate(meta.PEMPath)
+	Expect(err).NotTo(HaveOccurred())
+
+	s := &ProvisionCommand{renewPercent: 33}
+	start := issued.Add(60 * 24 * time.Hour)
+	selected := start.Add(12 * time.Hour)
+	ari := &fakeRenewalInfo{info: renewalWindow(start, start.Add(48*time.Hour), selected)}
+
+	Expect(s.renewalDue(context.Background(), ari, &meta, leaf, selected.Add(-time.Minute))).To(BeFalse())
+	Expect(ari.calls).To(Equal(1))
+
+	// saved with a default Retry-After, so the next run does not ask again
+	saved, err := readCertMetadata(filepath.Join(certsDir, "aa11.json"))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(saved.RenewalInfo.SelectedTime).To(BeTemporally("==", selected))
+	Expect(saved.RenewalInfo.RetryAfter).NotTo(BeNil())
+
+	Expect(s.renewalDue(context.Background(), ari, saved, leaf, selected)).To(BeTrue())
+	Expect(ari.calls).To(Equal(1))
+
+	// long after the window closed, e.g. a missed cron run
+	Expect(s.renewalDue(context.Background(), ari, saved, leaf, start.Add(20*24*time.Hour))).To(BeTrue())
+}
+
+func TestRenewalDueKeepsSelectedTime(t *testing.T) {
+	RegisterTestingT(t)
+
+	certsDir := t.TempDir()
+	issued := time.Now().Add(-10 * 24 * time.Hour)
+	meta := writeTestCertificate(certsDir, "aa11", issued, issued.Add(90*24*time.Hour))
+	leaf, err := readLeafCertificate(meta.PEMPath)
+	Expect(err).NotTo(HaveOccurred())
+
+	start := issued.Add(60 * 24 * time.Hour)
+	stored := renewalWindow(start, start.Add(48*time.Hour), start.Add(time.Hour))
+	expired := time.Now().Add(-time.Minute)
+	stored.RetryAfter = &expired
+	meta.RenewalInfo = &stored
+
+	s := &ProvisionCommand{renewPercent: 33}
+	ari := &fakeRenewalInfo{info: renewalWindow(start, start.Add(48*time.Hour), start.Add(40*time.Hour))}
+	Expect(s.renewalDue(context.Background(), ari, &meta, leaf, time.Now())).To(BeFalse())
+	Expect(ari.calls).To(Equal(1))
+	Expect(meta.RenewalInfo.SelectedTime).To(BeTemporally("==", start.Add(time.Hour)))
+
+	// a moved window, e.g. ahead of a mass revocation, replaces it
+	meta.RenewalInfo.RetryAfter = &expired
+	ari.info = renewalWindow(issued, issued.Add(time.Hour), issued.Add(time.Minute))
+	Expect(s.renewalDue(context.Background(), ari, &meta, leaf, time.Now())).To(BeTrue())
+	Expect(ari.calls).To(Equal(2))
+}
+
+func TestRenewalDueFallback(t *testing.T) {
+	RegisterTestingT(t)
+
+	certsDir := t.TempDir()
+	now := time.Now()
+	issued := now.Add(-50 * 24 * time.Hour)
+	meta := writeTestCertificate(certsDir, "aa11", issued, issued.Add(90*24*time.Hour))
+	leaf, err := readLeafCertificate(meta.PEMPath)
+	Expect(err).NotTo(HaveOccurred())
+
+	unsupported := &fakeRenewalInfo{err: acme.ErrUnsupported}
+	failing := &fakeRenewalInfo{err: errors.New("connection refused")}
+
+	// 40 of 90 days remain
+	s := &ProvisionCommand{renewPercent: 33}
+	Expect(s.renewalDue(context.Background(), unsupported, &meta, leaf, now)).To(BeFalse())
+	Expect(s.renewalDue(context.Background(), unsupported, &meta, leaf, now.Add(11*24*time.Hour))).To(BeTrue())
+
+	s = &ProvisionCommand{renewPercent: 50}
+	Expect(s.renewalDue(context.Background(), failing, &meta, leaf, now)).To(BeTrue())
+
+	s = &ProvisionCommand{renewBeforeDays: 45}
+	Expect(s.renewalDue(context.Background(), failing, &meta, leaf, now)).To(BeTrue())
+
+	s = &ProvisionCommand{renewBeforeDays: 30}
+	Expect(s.renewalDue(context.Background(), failing, &meta, leaf, now)).To(BeFalse())
+	Expect(s.renewalDue(context.Background(), failing, &meta, leaf, leaf.NotAfter)).To(BeTrue())
+
+	Expect(meta.RenewalInfo).To(BeNil())
+}
@@ -0,0 +1,251 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+)
+
+// Exit codes of the provision command. They are part of the interface
+// orchestration relies on, so existing values must never change.
+const (
+	ExitRenewed        = 0
+	ExitError          = 1
+	ExitUsage          = 2
+	ExitNotDue         = 3
+	ExitLockHeld       = 4
+	ExitDNSFailure     = 5
+	ExitACMEFailure    = 6
+	ExitInstallFailure = 7
+)
+
+const exitCodeHelp = `Exit codes:
+  0  a certificate was issued and installed
+  1  any other error
+  2  the command line or configuration is not valid
+  3  the certificate is not due for renewal
+  4  another provision run holds the lock
+  5  the DNS provider failed
+  6  the ACME server rejected the account or order
+  7  the certificate could not be installed`
+
+var errorClasses = map[int]string{
+	ExitError:          "other",
+	ExitUsage:          "usage",
+	ExitLockHeld:       "lock",
+	ExitDNSFailure:     "dns",
+	ExitACMEFailure:    "acme",
+	ExitInstallFailure: "install",
+}
+
+// exitStatus ends a successful run with a non-zero exit code, for results the
+// caller needs to tell apart but that are not failures.
+type exitStatus int
+
+func (e exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+func (e exitStatus) ExitCode() int {
+	return int(e)
+}
+
+// classifiedError attaches one of the exit codes above to an error. classify
+// never wraps one in another, so a more specific class given further down
+// is kept.
+type classifiedError struct {
+	code int
+	err  error
+}
+
+func classify(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	// keep a more specific class given further down
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return err
+	}
+
+	return &classifiedError{code: code, err: err}
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+func (e *classifiedError) ExitCode() int {
+	return e.code
+}
+
+// exitCode returns the exit code for err. Only the codes given here count:
+// other errors may carry one too, like the exit status of a failed child
+// process, which must not become the exit code of the run.
+func exitCode(err error) int {
+	var status exitStatus
+	if errors.As(err, &status) {
+		return status.ExitCode()
+	}
+
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return ce.ExitCode()
+	}
+
+	if err != nil {
+		return ExitError
+	}
+
+	return ExitRenewed
+}
+
+// provisionReport is the JSON summary written to --report-file. Consumers
+// depend on the field names.
+type provisionReport struct {
+	Outcome                 string         `json:"outcome"`
+	ExitCode                int            `json:"exitCode"`
+	ErrorClass              string         `json:"errorClass,omitempty"`
+	Error                   string         `json:"error,omitempty"`
+	StartedAt               time.Time      `json:"startedAt"`
+	FinishedAt              time.Time      `json:"finishedAt"`
+	Timings                 []reportTiming `json:"timings"`
+	Identifiers             []string       `json:"identifiers,omitempty"`
+	DirectoryURL            string         `json:"directoryURL"`
+	OrderURL                string         `json:"orderURL,omitempty"`
+	CertificateURL          string         `json:"certificateURL,omitempty"`
+	CertificateHash         string         `json:"certificateHash,omitempty"`
+	PreviousCertificateHash string         `json:"previousCertificateHash,omitempty"`
+}
+
+type reportTiming struct {
+	Phase     string    `json:"phase"`
+	StartedAt time.Time `json:"startedAt"`
+	Seconds   float64   `json:"seconds"`
+}
+
+// phase starts timing a step of the run. Call the returned function when it
+// is done.
+func (r *provisionReport) phase(name string) func() {
+	start := time.Now()
+	return func() {
+		r.Timings = append(r.Timings, reportTiming{Phase: name, StartedAt: start, Seconds: time.Since(start).Seconds()})
+	}
+}
+
+func (r *provisionReport) finish(err error) {
+	r.FinishedAt = time.Now()
+	r.ExitCode = exitCode(err)
+	switch r.ExitCode {
+	case ExitRenewed:
+		r.Outcome = "renewed"
+	case ExitNotDue:
+		r.Outcome = "not-due"
+	default:
+		r.Outcome = "failed"
+		r.ErrorClass = errorClasses[r.ExitCode]
+		r.Error = err.Error()
+	}
+}
+
+// write replaces path with the report, so readers never see a partial one.
+func (r *provisionReport) write(path string) error {
+	reportBytes, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(reportBytes, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// certificateHash returns the name certificates are stored under in certsDir.
+func certificateHash(c *acmeCertWithPath) string {
+	if c == nil {
+		return ""
+	}
+
+	return strings.TrimSuffix(filepath.Base(c.PEMPath), ".pem")
+}
+
+// dnsSolver marks errors coming from the DNS provider, which acmez wraps in
+// its own, so they can be told apart from the CA rejecting the order.
+type dnsSolver struct {
+	acmez.Solver
+}
+
+func (d dnsSolver) Present(ctx context.Context, chal acme.Challenge) error {
+	return classify(ExitDNSFailure, d.Solver.Present(ctx, chal))
+}
+
+func (d dnsSolver) Wait(ctx context.Context, chal acme.Challenge) error {
+	if w, ok := d.Solver.(acmez.Waiter); ok {
+		return classify(ExitDNSFailure, w.Wait(ctx, chal))
+	}
+
+	return nil
+}
+
+// orderRecorder is a log handler that picks the order URL out of the records
+// acmez logs, as it is not returned otherwise.
+type orderRecorder struct {
+	slog.Handler
+	orderURL *string
+}
+
+// Enabled lets every record through to Handle, so the order URL is seen even
+// at verbosity levels where it is not logged.
+func (orderRecorder) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (o orderRecorder) Handle(ctx context.Context, r slog.Record) error {
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "order" && a.Value.String() != "" {
+			*o.orderURL = a.Value.String()
+		}
+		return true
+	})
+
+	if !o.Handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+
+	return o.Handler.Handle(ctx, r)
+}
+
+func (o orderRecorder) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return orderRecorder{Handler: o.Handler.WithAttrs(attrs), orderURL: o.orderURL}
+}
+
+func (o orderRecorder) WithGroup(name string) slog.Handler {
+	return orderRecorder{Handler: o.Handler.WithGroup(name), orderURL: o.orderURL}
+}
@@ -0,0 +1,93 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/acmez/v3/acme"
+	. "github.com/onsi/gomega"
+)
+
+type failingSolver struct{}
+
+func (failingSolver) Present(context.Context, acme.Challenge) error {
+	return errors.New("access denied")
+}
+
+func (failingSolver) CleanUp(context.Context, acme.Challenge) error {
+	return nil
+}
+
+func TestExitCodes(t *testing.T) {
+	RegisterTestingT(t)
+
+	Expect(exitCode(nil)).To(Equal(ExitRenewed))
+	Expect(exitCode(errors.New("boom"))).To(Equal(ExitError))
+	Expect(exitCode(exitStatus(ExitNotDue))).To(Equal(ExitNotDue))
+
+	// a DNS failure surfacing through acmez stays a DNS failure
+	err := dnsSolver{failingSolver{}}.Present(context.Background(), acme.Challenge{})
+	err = classify(ExitACMEFailure, fmt.Errorf("solving challenges: %w", err))
+	Expect(exitCode(err)).To(Equal(ExitDNSFailure))
+	Expect(err).To(MatchError(ContainSubstring("access denied")))
+
+	// the exit status of a failed child process is not an exit code
+	err = exec.Command("sh", "-c", "exit 9").Run()
+	Expect(err).To(BeAssignableToTypeOf(&exec.ExitError{}))
+	err = fmt.Errorf("could not get the host FQDN: %w", err)
+	Expect(exitCode(err)).To(Equal(ExitError))
+	report := &provisionReport{}
+	report.finish(err)
+	Expect(report.ExitCode).To(Equal(ExitError))
+	Expect(report.ErrorClass).To(Equal("other"))
+	Expect(exitCode(classify(ExitInstallFailure, err))).To(Equal(ExitInstallFailure))
+
+	Expect(dnsSolver{failingSolver{}}.Wait(context.Background(), acme.Challenge{})).To(Succeed())
+	Expect(classify(ExitACMEFailure, nil)).To(Succeed())
+}
+
+func TestProvisionReport(t *testing.T) {
+	RegisterTestingT(t)
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	report := &provisionReport{}
+	done := report.phase("check")
+	done()
+	report.finish(classify(ExitInstallFailure, errors.New("read-only file system")))
+	Expect(report.write(path)).To(Succeed())
+
+	var written map[string]any
+	reportBytes, err := os.ReadFile(path)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(json.Unmarshal(reportBytes, &written)).To(Succeed())
+	Expect(written).To(HaveKeyWithValue("outcome", "failed"))
+	Expect(written).To(HaveKeyWithValue("errorClass", "install"))
+	Expect(written).To(HaveKeyWithValue("exitCode", BeNumerically("==", ExitInstallFailure)))
+	Expect(written["timings"]).To(HaveLen(1))
+
+	report = &provisionReport{}
+	report.finish(exitStatus(ExitNotDue))
+	Expect(report.Outcome).To(Equal("not-due"))
+	Expect(report.Error).To(BeEmpty())
+}
+
+func TestOrderRecorder(t *testing.T) {
+	RegisterTestingT(t)
+
+	var orderURL string
+	logger := slog.New(orderRecorder{
+		Handler:  slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError}),
+		orderURL: &orderURL,
+	})
+
+	logger.With(slog.String("identifier", "host.example")).Info("finalizing order", slog.String("order", "https://acme.example/order/1"))
+	Expect(orderURL).To(Equal("https://acme.example/order/1"))
+}
@@ -0,0 +1,195 @@
+package app
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/mholt/acmez/v3/acme"
+)
+
+// revocationReasons maps the --reason values to the RFC 5280 §5.3.1 codes.
+// Reason 7 is unused by the RFC.
+var revocationReasons = map[string]int{
+	"unspecified":            acme.ReasonUnspecified,
+	"key-compromise":         acme.ReasonKeyCompromise,
+	"ca-compromise":          acme.ReasonCACompromise,
+	"affiliation-changed":    acme.ReasonAffiliationChanged,
+	"superseded":             acme.ReasonSuperseded,
+	"cessation-of-operation": acme.ReasonCessationOfOperation,
+	"certificate-hold":       acme.ReasonCertificateHold,
+	"remove-from-crl":        acme.ReasonRemoveFromCRL,
+	"privilege-withdrawn":    acme.ReasonPrivilegeWithdrawn,
+	"aa-compromise":          acme.ReasonAACompromise,
+}
+
+type RevokeCommand struct {
+	accountClient `embed:""`
+
+	Hash     string `arg:"" optional:"" help:"The hash, or a unique prefix of it, of the certificate in the certs directory to revoke. Defaults to the certificate rui.crt points to"`
+	Reason   string `default:"unspecified" enum:"unspecified,key-compromise,ca-compromise,affiliation-changed,superseded,cessation-of-operation,certificate-hold,remove-from-crl,privilege-withdrawn,aa-compromise" help:"The RFC 5280 revocation reason"`
+	SignWith string `default:"account" enum:"account,certificate" help:"Sign the request with the ACME account key or with the certificate's own key, which works even without the account"`
+
+	certsDir  string
+	outputDir string
+}
+
+func (c *RevokeCommand) AfterApply(opts RunOptions) error {
+	if err := c.accountClient.AfterApply(opts); err != nil {
+		return err
+	}
+
+	c.certsDir = filepath.Join(opts.BaseDir, "certs")
+	c.outputDir = opts.TargetDirectory
+	return nil
+}
+
+func (c *RevokeCommand) Run(ctx context.Context, kctx *kong.Context) error {
+	jsonPath, meta, err := c.findCertificate()
+	if err != nil {
+		return err
+	}
+
+	if meta.RevokedAt != nil {
+		return fmt.Errorf("certificate %s was already revoked at %s", meta.PEMPath, meta.RevokedAt.Format(time.RFC3339))
+	}
+
+	leaf, err := readLeafCertificate(meta.PEMPath)
+	if err != nil {
+		return err
+	}
+
+	// the certificate has to be revoked at the CA that issued it, which is not
+	// necessarily the one currently configured
+	if meta.CA != "" && meta.CA != c.acmeURL {
+		c.acmeURL = meta.CA
+		c.client = newACMEClient(c.acmeURL)
+	}
+
+	var (
+		account acme.Account
+		signer  crypto.Signer
+	)
+	switch c.SignWith {
+	case "certificate":
+		if signer, err = c.certificateKey(meta, leaf.PublicKey); err != nil {
+			return err
+		}
+	default:
+		if account, err = c.account(ctx); err != nil {
+			return err
+		}
+		signer = account.PrivateKey
+	}
+
+	if err = c.client.RevokeCertificate(ctx, account, leaf, signer, revocationReasons[c.Reason]); err != nil {
+		return fmt.Errorf("could not revoke certificate %s: %w", meta.PEMPath, err)
+	}
+
+	now := time.Now().UTC()
+	meta.RevokedAt = &now
+	meta.RevocationReason = c.Reason
+	if err = writeCertMetadata(jsonPath, *meta); err != nil {
+		return fmt.Errorf("certificate was revoked but %s could not be updated: %w", jsonPath, err)
+	}
+
+	slog.Info("revoked certificate", slog.String("pem-path", meta.PEMPath), slog.String("reason", c.Reason))
+	if active, _ := readActiveCertMetadata(c.outputDir); active != nil && active.PEMPath == meta.PEMPath {
+		slog.Warn("the revoked certificate is still installed, run provision to replace it")
+	}
+
+	return c.printRevoked(kctx, *meta)
+}
+
+// findCertificate returns the metadata file and contents of the certificate
+// selected by Hash, or of the active certificate if no hash was given.
+func (c *RevokeCommand) findCertificate() (string, *acmeCertWithPath, error) {
+	if c.Hash == "" {
+		meta, err := readActiveCertMetadata(c.outputDir)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if meta == nil {
+			return "", nil, fmt.Errorf("%s is not a certificate installed by %s, pass the hash of the certificate to revoke", filepath.Join(c.outputDir, certFile), Name)
+		}
+
+		return strings.TrimSuffix(meta.PEMPath, ".pem") + ".json", meta, nil
+	}
+
+	matches, err := filepath.Glob(filepath.Join(c.certsDir, c.Hash+"*.json"))
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", nil, fmt.Errorf("no certificate matching %s in %s", c.Hash, c.certsDir)
+	case 1:
+	default:
+		sort.Strings(matches)
+		return "", nil, fmt.Errorf("%s matches more than one certificate: %s", c.Hash, strings.Join(matches, ", "))
+	}
+
+	meta, err := readCertMetadata(matches[0])
+	if err != nil {
+		return "", nil, fmt.Errorf("could not read certificate metadata %s: %w", matches[0], err)
+	}
+
+	return matches[0], meta, nil
+}
+
+// certificateKey loads the private key belonging to the certificate. Older
+// certificates have no key of their own, so the legacy acme.cpk is tried too,
+// as long as it matches the certificate.
+func (c *RevokeCommand) certificateKey(meta *acmeCertWithPath, pub crypto.PublicKey) (crypto.Signer, error) {
+	keyPath := meta.KeyPath
+	if keyPath == "" {
+		keyPath = filepath.Join(c.configDir, "acme.cpk")
+	}
+
+	keyBytes, err := os.ReadFile(keyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("the certificate key is gone, use --sign-with=account: %w", err)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse certificate key %s: %w", keyPath, err)
+	}
+
+	if !samePublicKey(key.Public(), pub) {
+		return nil, fmt.Errorf("%s is not the key of the certificate, use --sign-with=account", keyPath)
+	}
+
+	return key, nil
+}
+
+func (c *RevokeCommand) printRevoked(kctx *kong.Context, meta acmeCertWithPath) error {
+	if c.Output == "json" {
+		enc := json.NewEncoder(kctx.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(meta)
+	}
+
+	tw := tabwriter.NewWriter(kctx.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Certificate:\t%s\n", meta.PEMPath)
+	fmt.Fprintf(tw, "Revoked at:\t%s\n", meta.RevokedAt.Format(time.RFC3339))
+	fmt.Fprintf(tw, "Reason:\t%s\n", meta.RevocationReason)
+	return tw.Flush()
+}
@@ -0,0 +1,107 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// writeTestCertificate stores a self-signed certificate for host.example in
+// certsDir under hash the way provision does, and returns its metadata.
+func writeTestCertificate(certsDir, hash string, notBefore, notAfter time.Time) acmeCertWithPath {
+	key, err := generatePrivateKey(keyTypeEC256, rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "host.example"},
+		DNSNames:     []string{"host.example"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	Expect(err).NotTo(HaveOccurred())
+
+	keyPEM, err := encodePrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	meta := acmeCertWithPath{
+		PEMPath:     filepath.Join(certsDir, hash+".pem"),
+		KeyType:     keyTypeEC256,
+		KeyPath:     filepath.Join(certsDir, hash+".key"),
+		KeyRenewals: 1,
+	}
+	Expect(os.WriteFile(meta.PEMPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)).To(Succeed())
+	Expect(os.WriteFile(meta.KeyPath, keyPEM, 0o400)).To(Succeed())
+	Expect(writeCertMetadata(filepath.Join(certsDir, hash+".json"), meta)).To(Succeed())
+
+	return meta
+}
+
+func TestRevokeFindCertificate(t *testing.T) {
+	RegisterTestingT(t)
+
+	baseDir, outputDir := t.TempDir(), t.TempDir()
+	certsDir := filepath.Join(baseDir, "certs")
+	Expect(os.MkdirAll(certsDir, 0o755)).To(Succeed())
+
+	now := time.Now()
+	active := writeTestCertificate(certsDir, "aa11", now, now.Add(90*24*time.Hour))
+	writeTestCertificate(certsDir, "aa22", now, now.Add(90*24*time.Hour))
+	other := writeTestCertificate(certsDir, "bb33", now, now.Add(90*24*time.Hour))
+
+	cmd := &RevokeCommand{}
+	Expect(cmd.AfterApply(RunOptions{BaseDir: baseDir, TargetDirectory: outputDir})).To(Succeed())
+
+	_, _, err := cmd.findCertificate()
+	Expect(err).To(MatchError(ContainSubstring("pass the hash")))
+
+	Expect(os.Symlink(active.PEMPath, filepath.Join(outputDir, certFile))).To(Succeed())
+	jsonPath, meta, err := cmd.findCertificate()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(jsonPath).To(Equal(filepath.Join(certsDir, "aa11.json")))
+	Expect(meta.PEMPath).To(Equal(active.PEMPath))
+
+	cmd.Hash = "aa"
+	_, _, err = cmd.findCertificate()
+	Expect(err).To(MatchError(ContainSubstring("more than one")))
+
+	cmd.Hash = "b"
+	_, meta, err = cmd.findCertificate()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(meta.PEMPath).To(Equal(other.PEMPath))
+
+	cmd.Hash = "cc"
+	_, _, err = cmd.findCertificate()
+	Expect(err).To(MatchError(ContainSubstring("no certificate matching")))
+}
+
+func TestRevokeCertificateKey(t *testing.T) {
+	RegisterTestingT(t)
+
+	certsDir := t.TempDir()
+	now := time.Now()
+	meta := writeTestCertificate(certsDir, "aa11", now, now.Add(time.Hour))
+	other := writeTestCertificate(certsDir, "bb22", now, now.Add(time.Hour))
+
+	leaf, err := readLeafCertificate(meta.PEMPath)
+	Expect(err).NotTo(HaveOccurred())
+
+	cmd := &RevokeCommand{}
+	key, err := cmd.certificateKey(&meta, leaf.PublicKey)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(key.Public()).To(Equal(leaf.PublicKey))
+
+	_, err = cmd.certificateKey(&other, leaf.PublicKey)
+	Expect(err).To(MatchError(ContainSubstring("is not the key of the certificate")))
+}
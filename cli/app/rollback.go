@@ -0,0 +1,323 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kong"
+)
+
+const originalCandidateID = "original"
+
+type RollbackCommand struct {
+	Target string `arg:"" optional:"" help:"The certificate to install: 'original' for the certificate ESXi generated, or the hash (or a unique prefix of it) of a stored certificate. Lists the candidates if omitted"`
+	Force  bool   `help:"Install the certificate even if it has expired or was revoked"`
+	Output string `short:"o" default:"text" enum:"text,json" help:"Output format of the list, text or json"`
+	Wait   bool   `env:"LE_ESXI_WAIT" help:"Wait for a run in progress to finish instead of failing"`
+
+	outputDir  string
+	certsDir   string
+	configDir  string
+	runDir     string
+	activation activation
+	history    historyJournal
+}
+
+// installCandidate is a certificate rollback can install.
+type installCandidate struct {
+	ID        string     `json:"id"`
+	Active    bool       `json:"active"`
+	CertPath  string     `json:"certPath"`
+	KeyPath   string     `json:"keyPath"`
+	CA        string     `json:"ca,omitempty"`
+	SANs      []string   `json:"sans"`
+	NotAfter  time.Time  `json:"notAfter"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+func (c installCandidate) original() bool {
+	return c.ID == originalCandidateID
+}
+
+func (c *RollbackCommand) AfterApply(opts RunOptions) error {
+	c.outputDir = opts.TargetDirectory
+	c.certsDir = filepath.Join(opts.BaseDir, "certs")
+	c.configDir = filepath.Join(opts.BaseDir, ".config")
+	c.runDir = filepath.Join(opts.BaseDir, "run")
+	c.activation = newActivation(opts)
+	c.history = newHistoryJournal(opts, "rollback")
+	return nil
+}
+
+func (c *RollbackCommand) Run(ctx context.Context, kctx *kong.Context) (err error) {
+	if c.Target == "" {
+		candidates, err := c.candidates()
+		if err != nil {
+			return err
+		}
+
+		return c.print(kctx.Stdout, candidates)
+	}
+
+	// a provision run must not replace the certificate in the middle of this
+	lock, err := acquireRunLock(ctx, c.runDir, "rollback", c.Wait)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	// the run that held the lock before may have been killed in a swap
+	if err = recoverSwap(c.runDir, c.outputDir, c.history); err != nil {
+		return fmt.Errorf("could not recover an interrupted certificate swap: %w", err)
+	}
+
+	candidates, err := c.candidates()
+	if err != nil {
+		return err
+	}
+
+	target, err := c.choose(candidates, time.Now())
+	if err != nil {
+		return err
+	}
+
+	entry := historyEntry{Action: historyActionRollback, NewHash: target.ID, KeyPath: target.KeyPath, CAURL: target.CA}
+	for _, candidate := range candidates {
+		if candidate.Active {
+			entry.OldHash = candidate.ID
+		}
+	}
+	defer func() {
+		c.history.record(entry, err)
+	}()
+
+	backups, err := c.install(target)
+	if err != nil {
+		return err
+	}
+	entry.Backups = backups
+
+	slog.Info("installed previous certificate", slog.String("id", target.ID), slog.String("cert-path", target.CertPath))
+	return c.activation.activateOrRollBack(ctx, filepath.Join(c.outputDir, certFile), backups)
+}
+
+// candidates lists the certificate ESXi generated, if a backup of it is left,
+// followed by the stored certificates, newest first.
+func (c *RollbackCommand) candidates() ([]installCandidate, error) {
+	var candidates []installCandidate
+
+	activeCert := filepath.Join(c.outputDir, certFile)
+	active, err := readActiveCertMetadata(c.outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if original, ok := c.originalCandidate(); ok {
+		// a regular rui.crt is the original itself
+		fi, err := os.Lstat(activeCert)
+		original.Active = err == nil && fi.Mode().IsRegular()
+		candidates = append(candidates, original)
+	}
+
+	metadataFiles, err := filepath.Glob(filepath.Join(c.certsDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var stored []installCandidate
+	for _, jsonPath := range metadataFiles {
+		meta, err := readCertMetadata(jsonPath)
+		if err != nil {
+			slog.Warn("skipping unreadable certificate metadata", slog.String("path", jsonPath), slog.Any("error", err))
+			continue
+		}
+
+		leaf, err := readLeafCertificate(meta.PEMPath)
+		if err != nil {
+			slog.Warn("skipping unreadable certificate", slog.String("path", meta.PEMPath), slog.Any("error", err))
+			continue
+		}
+
+		keyPath := meta.KeyPath
+		if keyPath == "" {
+			// certificates issued before keys were stored per certificate
+			keyPath = filepath.Join(c.configDir, "acme.cpk")
+		}
+
+		if err = keyMatches(keyPath, leaf.PublicKey); err != nil {
+			slog.Debug("skipping certificate without its key", slog.String("path", meta.PEMPath), slog.Any("error", err))
+			continue
+		}
+
+		stored = append(stored, installCandidate{
+			ID:        certificateHash(meta),
+			Active:    active != nil && active.PEMPath == meta.PEMPath,
+			CertPath:  meta.PEMPath,
+			KeyPath:   keyPath,
+			CA:        meta.CA,
+			SANs:      installedSANs(leaf),
+			NotAfter:  leaf.NotAfter,
+			RevokedAt: meta.RevokedAt,
+		})
+	}
+
+	slices.SortFunc(stored, func(a, b installCandidate) int {
+		return b.NotAfter.Compare(a.NotAfter)
+	})
+
+	return append(candidates, stored...), nil
+}
+
+func (c *RollbackCommand) originalCandidate() (installCandidate, bool) {
+	return findOriginalCertificate(c.outputDir, c.history.path)
+}
+
+// findOriginalCertificate finds the newest backup of rui.crt in outputDir with
+// a matching backup of rui.key, which is the certificate ESXi generated. The
+// install history says which backups belong together; without it, the backup
+// files are paired up by their keys.
+func findOriginalCertificate(outputDir, historyPath string) (installCandidate, bool) {
+	entries, err := readHistory(historyPath)
+	if err != nil {
+		slog.Warn("could not read install history", slog.Any("error", err))
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		var certBackup, keyBackup string
+		for _, b := range entries[i].Backups {
+			switch b.Path {
+			case filepath.Join(outputDir, certFile):
+				certBackup = b.BackupPath
+			case filepath.Join(outputDir, privateKeyFile):
+				keyBackup = b.BackupPath
+			}
+		}
+
+		if certBackup == "" || keyBackup == "" {
+			continue
+		}
+
+		if candidate, ok := originalFromBackups([]string{certBackup}, []string{keyBackup}); ok {
+			return candidate, true
+		}
+	}
+
+	certBackups, _ := filepath.Glob(filepath.Join(outputDir, certFile+".*.bak"))
+	keyBackups, _ := filepath.Glob(filepath.Join(outputDir, privateKeyFile+".*.bak"))
+
+	// the names end in a nanosecond timestamp of the same length for the
+	// foreseeable future, so they sort by age
+	slices.Sort(certBackups)
+	slices.Reverse(certBackups)
+	return originalFromBackups(certBackups, keyBackups)
+}
+
+// originalFromBackups returns the first of certBackups with a matching key in
+// keyBackups.
+func originalFromBackups(certBackups, keyBackups []string) (installCandidate, bool) {
+	for _, certBackup := range certBackups {
+		leaf, err := readLeafCertificate(certBackup)
+		if err != nil {
+			continue
+		}
+
+		for _, keyBackup := range keyBackups {
+			if keyMatches(keyBackup, leaf.PublicKey) == nil {
+				return installCandidate{
+					ID:       originalCandidateID,
+					CertPath: certBackup,
+					KeyPath:  keyBackup,
+					SANs:     installedSANs(leaf),
+					NotAfter: leaf.NotAfter,
+				}, true
+			}
+		}
+	}
+
+	return installCandidate{}, false
+}
+
+func (c *RollbackCommand) choose(candidates []installCandidate, now time.Time) (installCandidate, error) {
+	var matches []installCandidate
+	for _, candidate := range candidates {
+		if candidate.ID == c.Target {
+			matches = []installCandidate{candidate}
+			break
+		}
+
+		if !candidate.original() && strings.HasPrefix(candidate.ID, c.Target) {
+			matches = append(matches, candidate)
+		}
+	}
+
+	if len(matches) == 0 {
+		return installCandidate{}, fmt.Errorf("no previous certificate matches %s, run rollback without arguments to list them", c.Target)
+	}
+
+	if len(matches) > 1 {
+		return installCandidate{}, fmt.Errorf("%s matches more than one certificate", c.Target)
+	}
+
+	target := matches[0]
+	switch {
+	case target.Active:
+		return target, fmt.Errorf("%s is already installed", target.ID)
+	case c.Force:
+	case target.RevokedAt != nil:
+		return target, fmt.Errorf("%s was revoked, pass --force to install it anyway", target.ID)
+	case !now.Before(target.NotAfter):
+		return target, fmt.Errorf("%s expired at %s, pass --force to install it anyway", target.ID, target.NotAfter.Format(time.RFC3339))
+	}
+
+	return target, nil
+}
+
+// install points rui.crt and rui.key at target. The original certificate is
+// copied back from its backup as a regular file, the way ESXi keeps it.
+func (c *RollbackCommand) install(target installCandidate) ([]tlsFileBackup, error) {
+	changes := []tlsFileChange{
+		{Path: filepath.Join(c.outputDir, privateKeyFile)},
+		{Path: filepath.Join(c.outputDir, certFile)},
+	}
+
+	if target.original() {
+		changes[0].Source, changes[1].Source = target.KeyPath, target.CertPath
+	} else {
+		changes[0].LinkTarget, changes[1].LinkTarget = target.KeyPath, target.CertPath
+	}
+
+	return swapTLSFiles(c.runDir, changes)
+}
+
+func (c *RollbackCommand) print(w io.Writer, candidates []installCandidate) error {
+	if c.Output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(candidates)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tACTIVE\tNOT AFTER\tREVOKED\tSANS")
+	for _, candidate := range candidates {
+		active, revoked := "", ""
+		if candidate.Active {
+			active = "*"
+		}
+		if candidate.RevokedAt != nil {
+			revoked = candidate.RevokedAt.Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", candidate.ID, active, candidate.NotAfter.Format(time.RFC3339), revoked, strings.Join(candidate.SANs, ", "))
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,98 @@
+package app
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestRollback(t *testing.T) {
+	RegisterTestingT(t)
+
+	baseDir, outputDir, vmwareDir := t.TempDir(), t.TempDir(), t.TempDir()
+	certsDir := filepath.Join(baseDir, "certs")
+	Expect(os.MkdirAll(certsDir, 0o755)).To(Succeed())
+
+	now := time.Now()
+	original := writeTestCertificate(vmwareDir, "vmware", now.Add(-time.Hour), now.Add(365*24*time.Hour))
+	older := writeTestCertificate(certsDir, "aa11", now.Add(-60*24*time.Hour), now.Add(30*24*time.Hour))
+	newer := writeTestCertificate(certsDir, "bb22", now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	writeTestCertificate(certsDir, "cc33", now.Add(-100*24*time.Hour), now.Add(-10*24*time.Hour))
+
+	for dst, src := range map[string]string{certFile: original.PEMPath, privateKeyFile: original.KeyPath} {
+		contents, err := os.ReadFile(src)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(outputDir, dst), contents, 0o600)).To(Succeed())
+	}
+
+	// provision replaced the original
+	p := &ProvisionCommand{outputDir: outputDir, runDir: filepath.Join(baseDir, "run")}
+	_, err := p.backupAndResetActiveTLSFiles(newer, nil)
+	Expect(err).NotTo(HaveOccurred())
+
+	c := &RollbackCommand{}
+	Expect(c.AfterApply(RunOptions{BaseDir: baseDir, TargetDirectory: outputDir})).To(Succeed())
+
+	candidates, err := c.candidates()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(candidates).To(HaveLen(4))
+	Expect(candidates[0].ID).To(Equal(originalCandidateID))
+	Expect(candidates[0].Active).To(BeFalse())
+	Expect(candidates[1].ID).To(Equal("bb22"))
+	Expect(candidates[1].Active).To(BeTrue())
+	Expect(candidates[2].ID).To(Equal("aa11"))
+	Expect(candidates[3].ID).To(Equal("cc33"))
+
+	c.Target = "bb"
+	_, err = c.choose(candidates, now)
+	Expect(err).To(MatchError(ContainSubstring("already installed")))
+
+	c.Target = "cc33"
+	_, err = c.choose(candidates, now)
+	Expect(err).To(MatchError(ContainSubstring("expired")))
+
+	// not while another run holds the lock
+	lock, err := acquireRunLock(context.Background(), c.runDir, "provision", false)
+	Expect(err).NotTo(HaveOccurred())
+	c.Target = "aa"
+	err = c.Run(context.Background(), nil)
+	Expect(exitCode(err)).To(Equal(ExitLockHeld))
+	Expect(os.Readlink(filepath.Join(outputDir, certFile))).To(Equal(newer.PEMPath))
+
+	// the run holding the lock is killed after switching only the key, and
+	// the swap is recovered once rollback takes the lock
+	interruptedSwap(c.runDir, outputDir, older, 1)
+	lock.release()
+
+	Expect(c.Run(context.Background(), nil)).To(Succeed())
+	Expect(os.Readlink(filepath.Join(outputDir, certFile))).To(Equal(older.PEMPath))
+	Expect(os.Readlink(filepath.Join(outputDir, privateKeyFile))).To(Equal(older.KeyPath))
+	Expect(filepath.Join(c.runDir, swapJournalFile)).NotTo(BeAnExistingFile())
+
+	entries, err := readHistory(c.history.path)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(entries).To(HaveLen(2))
+	Expect(entries[0].Action).To(Equal(historyActionRecover))
+	Expect(entries[0].Outcome).To(Equal(historyOutcomeRolledBack))
+	Expect(entries[1].Action).To(Equal(historyActionRollback))
+
+	c.Target = originalCandidateID
+	Expect(c.Run(context.Background(), nil)).To(Succeed())
+	for dst, src := range map[string]string{certFile: original.PEMPath, privateKeyFile: original.KeyPath} {
+		fi, err := os.Lstat(filepath.Join(outputDir, dst))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fi.Mode().IsRegular()).To(BeTrue())
+
+		want, err := os.ReadFile(src)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.ReadFile(filepath.Join(outputDir, dst))).To(Equal(want))
+	}
+
+	candidates, err = c.candidates()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(candidates[0].Active).To(BeTrue())
+}
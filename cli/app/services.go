@@ -0,0 +1,216 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	restartMethodInit     = "init"
+	restartMethodServices = "services.sh"
+
+	healthCheckInterval = 2 * time.Second
+)
+
+// activation makes the services use a newly installed certificate.
+type activation struct {
+	restarter *serviceRestarter
+	verifier  *certificateVerifier
+}
+
+func newActivation(opts RunOptions) activation {
+	return activation{restarter: newServiceRestarter(opts), verifier: newCertificateVerifier(opts)}
+}
+
+// activate restarts the services so they pick up the certificate installed
+// from pemPath, and checks it is being served.
+func (a activation) activate(ctx context.Context, pemPath string) error {
+	if a.restarter != nil {
+		if err := a.restarter.restart(ctx); err != nil {
+			return err
+		}
+	}
+
+	if a.verifier == nil {
+		return nil
+	}
+
+	leaf, err := readLeafCertificate(pemPath)
+	if err != nil {
+		return err
+	}
+
+	return a.verifier.verify(ctx, leaf)
+}
+
+// activateOrRollBack activates the certificate installed from pemPath, and
+// rolls back to backups if it is not served. It is not interrupted when ctx
+// is: stopping halfway could leave the services down, or roll back a
+// certificate that works.
+func (a activation) activateOrRollBack(ctx context.Context, pemPath string, backups []tlsFileBackup) error {
+	ctx = context.WithoutCancel(ctx)
+	err := a.activate(ctx, pemPath)
+	if err != nil && a.verifier != nil {
+		return a.rollBack(ctx, backups, err)
+	}
+
+	return err
+}
+
+// rollBack puts back the files the failed install replaced and restarts the
+// services again so they serve the previous certificate.
+func (a activation) rollBack(ctx context.Context, backups []tlsFileBackup, cause error) error {
+	slog.Error("the new certificate could not be activated, rolling back to the previous one", slog.Any("error", cause))
+
+	if err := restoreTLSFiles(backups); err != nil {
+		return errors.Join(cause, fmt.Errorf("could not restore the previous certificate: %w", err))
+	}
+
+	if a.restarter != nil {
+		if err := a.restarter.restart(ctx); err != nil {
+			return errors.Join(cause, fmt.Errorf("restored the previous certificate, but could not restart services: %w", err))
+		}
+	}
+
+	return fmt.Errorf("%w to the previous certificate: %w", errRolledBack, cause)
+}
+
+// serviceRestarter makes the ESXi management services pick up a newly
+// installed certificate.
+type serviceRestarter struct {
+	method         string
+	services       []string
+	initDir        string
+	servicesScript string
+	timeout        time.Duration
+}
+
+// newServiceRestarter returns nil if services should be left alone.
+func newServiceRestarter(opts RunOptions) *serviceRestarter {
+	if !opts.RestartServices {
+		return nil
+	}
+
+	return &serviceRestarter{
+		method:         opts.RestartMethod,
+		services:       opts.Services,
+		initDir:        "/etc/init.d",
+		servicesScript: "/sbin/services.sh",
+		timeout:        opts.RestartTimeout,
+	}
+}
+
+// restart restarts the services, giving up after the configured timeout.
+func (r *serviceRestarter) restart(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	if r.method == restartMethodServices {
+		// services.sh restarts every management agent, the list does not apply
+		if err := r.run(ctx, r.servicesScript, "restart"); err != nil {
+			return err
+		}
+	} else {
+		for _, svc := range r.services {
+			svc = strings.TrimSpace(svc)
+			if svc == "" {
+				continue
+			}
+
+			if err := r.run(ctx, filepath.Join(r.initDir, svc), "restart"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *serviceRestarter) run(ctx context.Context, name string, args ...string) error {
+	logger := slog.With(slog.String("command", name), slog.Any("args", args))
+	logger.Info("restarting services")
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s failed: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(output.String()))
+	}
+
+	logger.Debug("services restarted", slog.String("output", output.String()))
+	return nil
+}
+
+// certificateVerifier checks that the host serves a certificate over TLS.
+type certificateVerifier struct {
+	address string
+	timeout time.Duration
+}
+
+// newCertificateVerifier returns nil if installs should not be verified.
+func newCertificateVerifier(opts RunOptions) *certificateVerifier {
+	if !opts.Verify {
+		return nil
+	}
+
+	return &certificateVerifier{address: opts.HealthAddress, timeout: opts.VerifyTimeout}
+}
+
+// verify polls the address until it presents expected, giving up after the
+// configured timeout.
+func (v *certificateVerifier) verify(ctx context.Context, expected *x509.Certificate) error {
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+
+	for {
+		err := v.checkCertificate(ctx, expected)
+		if err == nil {
+			slog.Info("new certificate is being served", slog.String("address", v.address))
+			return nil
+		}
+
+		slog.Debug("new certificate not served yet", slog.String("address", v.address), slog.Any("error", err))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("new certificate was not served on %s in time: %w", v.address, err)
+		case <-time.After(healthCheckInterval):
+		}
+	}
+}
+
+func (v *certificateVerifier) checkCertificate(ctx context.Context, expected *x509.Certificate) error {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: healthCheckInterval},
+		// only the identity of the certificate matters here, whether it is
+		// trusted is up to the clients
+		Config: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", v.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	served := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(served) == 0 {
+		return errors.New("no certificate was presented")
+	}
+
+	if !served[0].Equal(expected) {
+		return fmt.Errorf("serving certificate with serial %s instead of %s", formatSerial(served[0]), formatSerial(expected))
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// serveTLS serves oldCert until the marker file exists, then newCert, the way
+// rhttpproxy only picks up a new certificate once restarted.
+func serveTLS(t *testing.T, oldCert, newCert acmeCertWithPath, marker string) string {
+	oldPair, err := tls.LoadX509KeyPair(oldCert.PEMPath, oldCert.KeyPath)
+	Expect(err).NotTo(HaveOccurred())
+	newPair, err := tls.LoadX509KeyPair(newCert.PEMPath, newCert.KeyPath)
+	Expect(err).NotTo(HaveOccurred())
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if _, err := os.Stat(marker); errors.Is(err, fs.ErrNotExist) {
+				return &oldPair, nil
+			}
+			return &newPair, nil
+		},
+	})
+	Expect(err).NotTo(HaveOccurred())
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func writeInitScript(initDir, name, body string) {
+	Expect(os.WriteFile(filepath.Join(initDir, name), []byte("#!/bin/sh\n"+body+"\n"), 0o755)).To(Succeed())
+}
+
+func TestRestartServices(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir, initDir := t.TempDir(), t.TempDir()
+	now := time.Now()
+	oldCert := writeTestCertificate(dir, "old", now, now.Add(time.Hour))
+	newCert := writeTestCertificate(dir, "new", now, now.Add(time.Hour))
+	marker := filepath.Join(dir, "restarted")
+	calls := filepath.Join(dir, "calls")
+
+	writeInitScript(initDir, "hostd", `echo "hostd $1" >> `+calls)
+	writeInitScript(initDir, "rhttpproxy", `echo "rhttpproxy $1" >> `+calls+` && touch `+marker)
+
+	restarter := &serviceRestarter{
+		method:   restartMethodInit,
+		services: []string{"hostd", "rhttpproxy"},
+		initDir:  initDir,
+		timeout:  10 * time.Second,
+	}
+	verifier := &certificateVerifier{address: serveTLS(t, oldCert, newCert, marker), timeout: 10 * time.Second}
+
+	expected, err := readLeafCertificate(newCert.PEMPath)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(restarter.restart(context.Background())).To(Succeed())
+	Expect(os.ReadFile(calls)).To(BeEquivalentTo("hostd restart\nrhttpproxy restart\n"))
+	Expect(verifier.verify(context.Background(), expected)).To(Succeed())
+
+	// services.sh ignores the list
+	Expect(os.Remove(calls)).To(Succeed())
+	writeInitScript(initDir, "services.sh", `echo "services.sh $1" >> `+calls)
+	restarter.method = restartMethodServices
+	restarter.servicesScript = filepath.Join(initDir, "services.sh")
+	Expect(restarter.restart(context.Background())).To(Succeed())
+	Expect(os.ReadFile(calls)).To(BeEquivalentTo("services.sh restart\n"))
+}
+
+func TestRestartServicesFailures(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir, initDir := t.TempDir(), t.TempDir()
+	now := time.Now()
+	oldCert := writeTestCertificate(dir, "old", now, now.Add(time.Hour))
+	newCert := writeTestCertificate(dir, "new", now, now.Add(time.Hour))
+
+	// nothing ever restarts the listener
+	verifier := &certificateVerifier{address: serveTLS(t, oldCert, newCert, filepath.Join(dir, "never")), timeout: 500 * time.Millisecond}
+	expected, err := readLeafCertificate(newCert.PEMPath)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(verifier.verify(context.Background(), expected)).To(MatchError(ContainSubstring("was not served")))
+
+	writeInitScript(initDir, "hostd", "echo hostd is broken; exit 1")
+	restarter := &serviceRestarter{method: restartMethodInit, services: []string{"hostd"}, initDir: initDir, timeout: time.Second}
+	Expect(restarter.restart(context.Background())).To(MatchError(ContainSubstring("hostd is broken")))
+
+	restarter.services = []string{"missing"}
+	Expect(restarter.restart(context.Background())).To(HaveOccurred())
+}
+
+func TestProvisionRollsBackUnservedCertificate(t *testing.T) {
+	RegisterTestingT(t)
+
+	certsDir, outputDir, initDir := t.TempDir(), t.TempDir(), t.TempDir()
+	now := time.Now()
+	original := writeTestCertificate(certsDir, "vmware", now, now.Add(time.Hour))
+	installed := writeTestCertificate(certsDir, "new", now, now.Add(time.Hour))
+
+	// ESXi's own files are regular files
+	files := map[string]string{certFile: original.PEMPath, privateKeyFile: original.KeyPath}
+	for dst, src := range files {
+		contents, err := os.ReadFile(src)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(outputDir, dst), contents, 0o600)).To(Succeed())
+	}
+	Expect(os.WriteFile(filepath.Join(outputDir, castore), []byte("vmware ca\n"), 0o644)).To(Succeed())
+
+	calls := filepath.Join(certsDir, "calls")
+	writeInitScript(initDir, "rhttpproxy", `echo "rhttpproxy $1" >> `+calls)
+
+	s := &ProvisionCommand{
+		outputDir: outputDir,
+		runDir:    filepath.Join(certsDir, "run"),
+		activation: activation{
+			restarter: &serviceRestarter{method: restartMethodInit, services: []string{"rhttpproxy"}, initDir: initDir, timeout: time.Second},
+			verifier:  &certificateVerifier{address: serveTLS(t, original, installed, filepath.Join(certsDir, "never")), timeout: 500 * time.Millisecond},
+		},
+	}
+
+	backups, err := s.backupAndResetActiveTLSFiles(installed, []byte("issuer ca\n"))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(os.Readlink(filepath.Join(outputDir, certFile))).To(Equal(installed.PEMPath))
+	Expect(os.ReadFile(filepath.Join(outputDir, castore))).To(ContainSubstring("issuer ca"))
+
+	err = s.activation.activate(context.Background(), installed.PEMPath)
+	Expect(err).To(MatchError(ContainSubstring("was not served")))
+	Expect(s.activation.rollBack(context.Background(), backups, err)).To(MatchError(ContainSubstring("rolled back")))
+
+	for dst, src := range files {
+		fi, err := os.Lstat(filepath.Join(outputDir, dst))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fi.Mode().IsRegular()).To(BeTrue())
+
+		want, err := os.ReadFile(src)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.ReadFile(filepath.Join(outputDir, dst))).To(Equal(want))
+	}
+	Expect(os.ReadFile(filepath.Join(outputDir, castore))).To(BeEquivalentTo("vmware ca\n"))
+	Expect(os.ReadFile(calls)).To(BeEquivalentTo("rhttpproxy restart\nrhttpproxy restart\n"))
+
+	// the stored certificates were not touched through the links
+	Expect(readLeafCertificate(installed.PEMPath)).NotTo(BeNil())
+}
+
+func TestActivationNotInterrupted(t *testing.T) {
+	RegisterTestingT(t)
+
+	certsDir, outputDir, initDir := t.TempDir(), t.TempDir(), t.TempDir()
+	now := time.Now()
+	original := writeTestCertificate(certsDir, "vmware", now, now.Add(time.Hour))
+	installed := writeTestCertificate(certsDir, "new", now, now.Add(time.Hour))
+	writeVMwareFiles(outputDir, original)
+
+	// the run is asked to stop while the services restart
+	started, marker := filepath.Join(certsDir, "started"), filepath.Join(certsDir, "restarted")
+	writeInitScript(initDir, "rhttpproxy", `: > `+started+` && sleep 1 && touch `+marker)
+
+	s := &ProvisionCommand{
+		outputDir: outputDir,
+		runDir:    filepath.Join(certsDir, "run"),
+		activation: activation{
+			restarter: &serviceRestarter{method: restartMethodInit, services: []string{"rhttpproxy"}, initDir: initDir, timeout: 10 * time.Second},
+			verifier:  &certificateVerifier{address: serveTLS(t, original, installed, marker), timeout: 10 * time.Second},
+		},
+	}
+
+	backups, err := s.backupAndResetActiveTLSFiles(installed, nil)
+	Expect(err).NotTo(HaveOccurred())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			if _, err := os.Stat(started); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	// the restart is finished and the certificate kept, not rolled back
+	Expect(s.activation.activateOrRollBack(ctx, installed.PEMPath, backups)).To(Succeed())
+	Expect(ctx.Err()).To(HaveOccurred())
+	Expect(marker).To(BeAnExistingFile())
+	Expect(os.Readlink(filepath.Join(outputDir, certFile))).To(Equal(installed.PEMPath))
+	Expect(os.Readlink(filepath.Join(outputDir, privateKeyFile))).To(Equal(installed.KeyPath))
+}
@@ -0,0 +1,211 @@
+package app
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kong"
+)
+
+type StatusCommand struct {
+	Output string `short:"o" default:"text" enum:"text,json" help:"Output format, text or json"`
+
+	outputDir       string
+	historyPath     string
+	renewBeforeDays int
+	renewPercent    int
+}
+
+// certificateStatus is what status reports, and the JSON monitoring scripts
+// consume, so fields should only ever be added.
+type certificateStatus struct {
+	CertificatePath string     `json:"certificatePath"`
+	KeyPath         string     `json:"keyPath"`
+	MetadataPath    string     `json:"metadataPath,omitempty"`
+	VMwareOriginal  bool       `json:"vmwareOriginal"`
+	Subject         string     `json:"subject"`
+	SANs            []string   `json:"sans"`
+	Issuer          string     `json:"issuer"`
+	SerialNumber    string     `json:"serialNumber"`
+	NotBefore       time.Time  `json:"notBefore"`
+	NotAfter        time.Time  `json:"notAfter"`
+	KeyType         string     `json:"keyType,omitempty"`
+	KeyMatches      bool       `json:"keyMatches"`
+	KeyError        string     `json:"keyError,omitempty"`
+	RenewalWindow   *timeRange `json:"renewalWindow,omitempty"`
+	ExplanationURL  string     `json:"explanationURL,omitempty"`
+	NextRenewal     time.Time  `json:"nextRenewal"`
+	RenewalBasis    string     `json:"renewalBasis"`
+	RevokedAt       *time.Time `json:"revokedAt,omitempty"`
+	InstalledAt     *time.Time `json:"installedAt,omitempty"`
+}
+
+type timeRange struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+func (c *StatusCommand) AfterApply(opts RunOptions) error {
+	c.outputDir = opts.TargetDirectory
+	c.historyPath = filepath.Join(opts.BaseDir, historyFile)
+	c.renewBeforeDays = opts.RenewBeforeDays
+	c.renewPercent = opts.RemainingPercent
+	return nil
+}
+
+func (c *StatusCommand) Run(kctx *kong.Context) error {
+	status, err := c.status(time.Now())
+	if err != nil {
+		return err
+	}
+
+	return c.print(kctx.Stdout, status)
+}
+
+func (c *StatusCommand) status(now time.Time) (certificateStatus, error) {
+	status := certificateStatus{
+		CertificatePath: filepath.Join(c.outputDir, certFile),
+		KeyPath:         filepath.Join(c.outputDir, privateKeyFile),
+	}
+
+	meta, err := readActiveCertMetadata(c.outputDir)
+	if err != nil {
+		return status, err
+	}
+
+	leaf, err := readLeafCertificate(status.CertificatePath)
+	if err != nil {
+		return status, err
+	}
+
+	status.Subject = leaf.Subject.String()
+	status.SANs = installedSANs(leaf)
+	status.Issuer = leaf.Issuer.String()
+	status.SerialNumber = formatSerial(leaf)
+	status.NotBefore = leaf.NotBefore
+	status.NotAfter = leaf.NotAfter
+	if kt, err := publicKeyType(leaf.PublicKey); err == nil {
+		status.KeyType = string(kt)
+	}
+
+	if err = keyMatches(status.KeyPath, leaf.PublicKey); err != nil {
+		status.KeyError = err.Error()
+	} else {
+		status.KeyMatches = true
+	}
+
+	switch {
+	case meta == nil:
+		// provision replaces the certificate ESXi generated on its next run
+		status.VMwareOriginal = true
+		status.NextRenewal = now
+		status.RenewalBasis = "not managed"
+	case meta.RevokedAt != nil:
+		status.RevokedAt = meta.RevokedAt
+		status.NextRenewal = now
+		status.RenewalBasis = "revoked"
+	case meta.RenewalInfo != nil && meta.RenewalInfo.HasWindow():
+		status.RenewalWindow = &timeRange{Start: meta.RenewalInfo.SuggestedWindow.Start, End: meta.RenewalInfo.SuggestedWindow.End}
+		status.ExplanationURL = meta.RenewalInfo.ExplanationURL
+		status.NextRenewal = ariRenewalTime(*meta.RenewalInfo)
+		status.RenewalBasis = "renewal info"
+	default:
+		status.NextRenewal = fallbackRenewalTime(leaf, c.renewBeforeDays, c.renewPercent)
+		status.RenewalBasis = "lifetime"
+	}
+
+	if meta != nil {
+		status.MetadataPath = strings.TrimSuffix(meta.PEMPath, ".pem") + ".json"
+
+		// the journal only adds detail, status works without it
+		if entries, err := readHistory(c.historyPath); err == nil {
+			status.InstalledAt = lastInstalled(entries, certificateHash(meta))
+		}
+	}
+
+	return status, nil
+}
+
+// keyMatches returns an error unless the private key at keyPath belongs to
+// pub.
+func keyMatches(keyPath string, pub crypto.PublicKey) error {
+	keyBytes, err := os.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+
+	key, err := parsePrivateKey(keyBytes)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %w", keyPath, err)
+	}
+
+	if !samePublicKey(key.Public(), pub) {
+		return fmt.Errorf("%s does not belong to the certificate", keyPath)
+	}
+
+	return nil
+}
+
+func formatSerial(cert *x509.Certificate) string {
+	hex := fmt.Sprintf("%X", cert.SerialNumber)
+	if len(hex)%2 == 1 {
+		hex = "0" + hex
+	}
+
+	pairs := make([]string, 0, len(hex)/2)
+	for i := 0; i < len(hex); i += 2 {
+		pairs = append(pairs, hex[i:i+2])
+	}
+
+	return strings.Join(pairs, ":")
+}
+
+func (c *StatusCommand) print(w io.Writer, status certificateStatus) error {
+	if c.Output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(status)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Certificate:\t%s\n", status.CertificatePath)
+	if status.VMwareOriginal {
+		fmt.Fprintf(tw, "Managed:\tno, this is the certificate ESXi generated\n")
+	} else {
+		fmt.Fprintf(tw, "Metadata:\t%s\n", status.MetadataPath)
+	}
+	fmt.Fprintf(tw, "Subject:\t%s\n", status.Subject)
+	fmt.Fprintf(tw, "SANs:\t%s\n", strings.Join(status.SANs, ", "))
+	fmt.Fprintf(tw, "Issuer:\t%s\n", status.Issuer)
+	fmt.Fprintf(tw, "Serial:\t%s\n", status.SerialNumber)
+	fmt.Fprintf(tw, "Not before:\t%s\n", status.NotBefore.Format(time.RFC3339))
+	fmt.Fprintf(tw, "Not after:\t%s\n", status.NotAfter.Format(time.RFC3339))
+	if status.InstalledAt != nil {
+		fmt.Fprintf(tw, "Installed at:\t%s\n", status.InstalledAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(tw, "Key type:\t%s\n", status.KeyType)
+	if status.KeyMatches {
+		fmt.Fprintf(tw, "Key matches:\tyes\n")
+	} else {
+		fmt.Fprintf(tw, "Key matches:\tno (%s)\n", status.KeyError)
+	}
+	if status.RevokedAt != nil {
+		fmt.Fprintf(tw, "Revoked at:\t%s\n", status.RevokedAt.Format(time.RFC3339))
+	}
+	if status.RenewalWindow != nil {
+		fmt.Fprintf(tw, "Renewal window:\t%s - %s\n", status.RenewalWindow.Start.Format(time.RFC3339), status.RenewalWindow.End.Format(time.RFC3339))
+	}
+	if status.ExplanationURL != "" {
+		fmt.Fprintf(tw, "Explanation:\t%s\n", status.ExplanationURL)
+	}
+	fmt.Fprintf(tw, "Next renewal:\t%s (%s)\n", status.NextRenewal.Format(time.RFC3339), status.RenewalBasis)
+	return tw.Flush()
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestStatus(t *testing.T) {
+	RegisterTestingT(t)
+
+	certsDir, outputDir := t.TempDir(), t.TempDir()
+	now := time.Now().Truncate(time.Second)
+	original := writeTestCertificate(certsDir, "vmware", now.Add(-time.Hour), now.Add(365*24*time.Hour))
+	managed := writeTestCertificate(certsDir, "aa11", now.Add(-time.Hour), now.Add(90*24*time.Hour))
+
+	// the files ESXi generated are plain files
+	for src, dst := range map[string]string{original.PEMPath: certFile, original.KeyPath: privateKeyFile} {
+		contents, err := os.ReadFile(src)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(outputDir, dst), contents, 0o600)).To(Succeed())
+	}
+
+	cmd := &StatusCommand{}
+	Expect(cmd.AfterApply(RunOptions{TargetDirectory: outputDir, RemainingPercent: 33})).To(Succeed())
+
+	status, err := cmd.status(now)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(status.VMwareOriginal).To(BeTrue())
+	Expect(status.KeyMatches).To(BeTrue())
+	Expect(status.SANs).To(Equal([]string{"host.example"}))
+	Expect(status.KeyType).To(Equal("ec256"))
+	Expect(status.NextRenewal).To(Equal(now))
+
+	for _, f := range []string{certFile, privateKeyFile} {
+		Expect(os.Remove(filepath.Join(outputDir, f))).To(Succeed())
+	}
+	Expect(os.Symlink(managed.PEMPath, filepath.Join(outputDir, certFile))).To(Succeed())
+	Expect(os.Symlink(original.KeyPath, filepath.Join(outputDir, privateKeyFile))).To(Succeed())
+
+	status, err = cmd.status(now)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(status.VMwareOriginal).To(BeFalse())
+	Expect(status.MetadataPath).To(Equal(filepath.Join(certsDir, "aa11.json")))
+	Expect(status.KeyMatches).To(BeFalse())
+	Expect(status.KeyError).To(ContainSubstring("does not belong"))
+	Expect(status.RenewalBasis).To(Equal("lifetime"))
+	// a third of the 90 day lifetime
+	Expect(status.NextRenewal).To(BeTemporally("~", now.Add(60*24*time.Hour), 12*time.Hour))
+
+	info := renewalWindow(now.Add(50*24*time.Hour), now.Add(52*24*time.Hour), now.Add(51*24*time.Hour))
+	managed.RenewalInfo = &info
+	Expect(writeCertMetadata(filepath.Join(certsDir, "aa11.json"), managed)).To(Succeed())
+
+	status, err = cmd.status(now)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(status.RenewalBasis).To(Equal("renewal info"))
+	Expect(status.RenewalWindow.Start).To(BeTemporally("==", info.SuggestedWindow.Start))
+	Expect(status.NextRenewal).To(BeTemporally("==", info.SelectedTime))
+}
@@ -1,32 +1,59 @@
 package app
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type StopCommand struct {
-	pidFile string
+	Timeout time.Duration `env:"LE_ESXI_STOP_TIMEOUT" help:"How long to wait for the run to stop before killing it. Defaults to twice --restart-timeout plus --verify-timeout and a minute, as a run being stopped may still restart the services, wait for the new certificate to be served, and restart them again to roll it back"`
+
+	lockFile string
+	exePath  string
+}
+
+func (s *StopCommand) Help() string {
+	return `Asks the running provision or daemon command to stop with SIGTERM. A run that has
+started replacing the certificate first finishes installing and activating it, or
+rolling it back. A run that has not stopped when the timeout runs out is killed, and
+the next run recovers any certificate swap it left behind.`
 }
 
-func (s *StopCommand) BeforeApply(opts RunOptions) error {
-	s.pidFile = filepath.Join(opts.BaseDir, "run", "pid")
+func (s *StopCommand) AfterApply(opts RunOptions) error {
+	s.lockFile = filepath.Join(opts.BaseDir, "run", runLockFile)
+	if s.Timeout <= 0 {
+		s.Timeout = 2*opts.RestartTimeout + opts.VerifyTimeout + time.Minute
+	}
+
+	exePath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	s.exePath = exePath
+
 	return nil
 }
 
 func (s *StopCommand) Run() error {
-	pidBytes, err := os.ReadFile(s.pidFile)
+	owner, held, err := runLockHolder(s.lockFile)
 	if err != nil {
-		slog.Warn("attempted to stop running process but could not", slog.Any("error", err))
+		slog.Warn("run lock not valid", slog.String("lock-file", s.lockFile), slog.Any("error", err))
 		return err
 	}
 
-	var pid int
-	if _, err = fmt.Sscan(string(pidBytes), &pid); err != nil {
-		slog.Warn("pid file not valid", slog.String("saved-pid", string(pidBytes)), slog.Any("error", err))
-		return err
+	// a run that was killed left its PID behind, which may have been reused
+	pid := owner.PID
+	if !held || !s.ownProcess(pid) {
+		slog.Info("no run in progress", slog.String("lock-file", s.lockFile))
+		return nil
 	}
 
 	proc, err := os.FindProcess(pid)
@@ -34,7 +61,53 @@ func (s *StopCommand) Run() error {
 		return err
 	}
 
-	err = proc.Kill()
-	os.Remove(s.pidFile)
-	return err
+	slog.Info("stopping running process", slog.String("run", owner.String()), slog.Duration("timeout", s.Timeout))
+	if err = proc.Signal(syscall.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("could not stop process %d: %w", pid, err)
+	}
+
+	if !waitForExit(pid, s.Timeout) {
+		slog.Warn("process did not stop in time, killing it", slog.Int("pid", pid), slog.Duration("timeout", s.Timeout))
+		if err = proc.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			return fmt.Errorf("could not kill process %d: %w", pid, err)
+		}
+
+		if !waitForExit(pid, 5*time.Second) {
+			return fmt.Errorf("process %d did not exit after being killed", pid)
+		}
+	}
+
+	slog.Info("stopped running process", slog.Int("pid", pid))
+	return nil
+}
+
+// ownProcess reports whether pid runs the same executable as this process.
+// Where /proc is not available, as on ESXi, it compares the name ps lists.
+func (s *StopCommand) ownProcess(pid int) bool {
+	proc := filepath.Join("/proc", strconv.Itoa(pid))
+	if exe, err := os.Readlink(filepath.Join(proc, "exe")); err == nil {
+		// the executable may have been replaced by an upgrade since it started
+		return strings.TrimSuffix(exe, " (deleted)") == s.exePath
+	}
+
+	if cmdline, err := os.ReadFile(filepath.Join(proc, "cmdline")); err == nil {
+		argv0, _, _ := bytes.Cut(cmdline, []byte{0})
+		return filepath.Base(string(argv0)) == filepath.Base(s.exePath)
+	}
+
+	name, ok := listProcesses()[pid]
+	return ok && filepath.Base(name) == filepath.Base(s.exePath)
+}
+
+// waitForExit waits up to timeout for pid to exit, and reports whether it did.
+func waitForExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return true
 }
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// startOwnProcess starts a copy of the shell under the name stop looks for,
+// which runs setup and then waits, and returns its pid and a channel closed
+// once it exited.
+func startOwnProcess(t *testing.T, dir, setup string) (int, <-chan struct{}) {
+	sh, err := exec.LookPath("sh")
+	Expect(err).NotTo(HaveOccurred())
+	contents, err := os.ReadFile(sh)
+	Expect(err).NotTo(HaveOccurred())
+
+	exePath := filepath.Join(dir, Name)
+	Expect(os.WriteFile(exePath, contents, 0o755)).To(Succeed())
+
+	// read blocks on the pipe for as long as the test runs
+	r, w, err := os.Pipe()
+	Expect(err).NotTo(HaveOccurred())
+	t.Cleanup(func() { r.Close(); w.Close() })
+
+	ready := filepath.Join(dir, "ready")
+	cmd := exec.Command(exePath, "-c", setup+"; : > "+ready+"; read x")
+	cmd.Stdin = r
+	Expect(cmd.Start()).To(Succeed())
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	Eventually(ready).Should(BeAnExistingFile())
+
+	return cmd.Process.Pid, exited
+}
+
+func newTestStop(t *testing.T, dir string, pid int, timeout time.Duration) *StopCommand {
+	s := &StopCommand{Timeout: timeout}
+	Expect(s.AfterApply(RunOptions{BaseDir: dir})).To(Succeed())
+	s.exePath = filepath.Join(dir, Name)
+
+	// the lock is held here, on behalf of the process
+	lock, err := acquireRunLock(context.Background(), filepath.Dir(s.lockFile), "provision", false)
+	Expect(err).NotTo(HaveOccurred())
+	t.Cleanup(lock.release)
+	Expect(os.WriteFile(s.lockFile, []byte(strconv.Itoa(pid)+"\n"), 0o600)).To(Succeed())
+	return s
+}
+
+func TestStopDefaultTimeout(t *testing.T) {
+	RegisterTestingT(t)
+
+	// enough for a restart, the verification, and the restart of a rollback
+	s := &StopCommand{}
+	Expect(s.AfterApply(RunOptions{BaseDir: t.TempDir(), RestartTimeout: 5 * time.Minute, VerifyTimeout: 2 * time.Minute})).To(Succeed())
+	Expect(s.Timeout).To(Equal(13 * time.Minute))
+
+	s = &StopCommand{Timeout: time.Minute}
+	Expect(s.AfterApply(RunOptions{BaseDir: t.TempDir(), RestartTimeout: 5 * time.Minute, VerifyTimeout: 2 * time.Minute})).To(Succeed())
+	Expect(s.Timeout).To(Equal(time.Minute))
+}
+
+func TestStopTerminates(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := t.TempDir()
+	pid, exited := startOwnProcess(t, dir, ":")
+	s := newTestStop(t, dir, pid, 5*time.Second)
+
+	Expect(s.Run()).To(Succeed())
+	Eventually(exited).Should(BeClosed())
+}
+
+func TestStopKillsAfterTimeout(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := t.TempDir()
+	pid, exited := startOwnProcess(t, dir, `trap "" TERM`)
+	s := newTestStop(t, dir, pid, 500*time.Millisecond)
+
+	started := time.Now()
+	Expect(s.Run()).To(Succeed())
+	Expect(time.Since(started)).To(BeNumerically(">=", 500*time.Millisecond))
+	Eventually(exited).Should(BeClosed())
+}
+
+func TestStopNotRunning(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := t.TempDir()
+
+	// the lock names a process that is not ours
+	other := exec.Command("sleep", "60")
+	Expect(other.Start()).To(Succeed())
+	t.Cleanup(func() { other.Process.Kill(); other.Wait() })
+
+	s := newTestStop(t, dir, other.Process.Pid, time.Second)
+	Expect(s.Run()).To(Succeed())
+	Expect(processAlive(other.Process.Pid)).To(BeTrue())
+
+	// a run that was killed left its PID behind, but not the lock
+	dir = t.TempDir()
+	s = &StopCommand{}
+	Expect(s.AfterApply(RunOptions{BaseDir: dir})).To(Succeed())
+	Expect(s.Run()).To(Succeed())
+
+	Expect(os.MkdirAll(filepath.Dir(s.lockFile), 0o755)).To(Succeed())
+	Expect(os.WriteFile(s.lockFile, []byte(strconv.Itoa(other.Process.Pid)), 0o600)).To(Succeed())
+	Expect(s.Run()).To(Succeed())
+	Expect(processAlive(other.Process.Pid)).To(BeTrue())
+}
@@ -0,0 +1,429 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// swapJournalFile lives in the run directory while the active TLS files are
+// being replaced, so an interrupted swap can be finished or undone.
+const swapJournalFile = "swap.json"
+
+// tlsFileChange is one file of a swap. Path becomes a symlink to LinkTarget, a
+// copy of Source, or a file holding Contents.
+type tlsFileChange struct {
+	Path       string        `json:"path"`
+	LinkTarget string        `json:"linkTarget,omitempty"`
+	Source     string        `json:"source,omitempty"`
+	Contents   []byte        `json:"-"`
+	Staged     string        `json:"staged"`
+	Backup     tlsFileBackup `json:"backup"`
+}
+
+type tlsFileSwap struct {
+	PID       int             `json:"pid"`
+	StartedAt time.Time       `json:"startedAt"`
+	Changes   []tlsFileChange `json:"changes"`
+}
+
+// swapTLSFiles replaces the files in changes as a set. Every new file is
+// staged next to the one it replaces and renamed over it, so each file is
+// always either entirely old or entirely new, and the journal in runDir lets
+// recoverSwap put the set back together if the swap is interrupted. It refuses
+// to start while the journal of an earlier swap is left.
+func swapTLSFiles(runDir string, changes []tlsFileChange) (backups []tlsFileBackup, err error) {
+	// backing up files an earlier swap left half replaced would keep a key and
+	// certificate that do not belong together
+	journal := filepath.Join(runDir, swapJournalFile)
+	if _, err := os.Lstat(journal); err == nil {
+		return nil, fmt.Errorf("an interrupted certificate swap was not recovered, see %s", journal)
+	}
+
+	// recovery tells from the staged files that remain how far a swap got,
+	// so they stay as long as the journal does
+	keepStaged := false
+	defer func() {
+		if err != nil && !keepStaged {
+			for _, c := range changes {
+				if c.Staged != "" {
+					os.Remove(c.Staged)
+				}
+			}
+		}
+	}()
+
+	for i := range changes {
+		c := &changes[i]
+		if c.Backup, err = backupFile(c.Path); err != nil {
+			return nil, err
+		}
+
+		c.Staged = stagedPath(c.Path)
+		if err = c.stage(); err != nil {
+			return nil, fmt.Errorf("could not stage %s: %w", c.Path, err)
+		}
+	}
+
+	if err = os.MkdirAll(runDir, 0o700); err != nil {
+		return nil, err
+	}
+
+	swap := tlsFileSwap{PID: os.Getpid(), StartedAt: time.Now().UTC(), Changes: changes}
+	if err = writeSwapJournal(journal, swap); err != nil {
+		return nil, fmt.Errorf("could not write swap journal: %w", err)
+	}
+
+	for _, c := range changes {
+		if err = os.Rename(c.Staged, c.Path); err != nil {
+			err = fmt.Errorf("could not replace %s: %w", c.Path, err)
+			if rerr := restoreTLSFiles(swapBackups(changes)); rerr != nil {
+				// leave the journal, recovery will try again
+				keepStaged = true
+				return nil, errors.Join(err, fmt.Errorf("could not restore previous files: %w", rerr))
+			}
+
+			removeSwapJournal(journal)
+			return nil, err
+		}
+	}
+
+	syncDirs(changes)
+	removeSwapJournal(journal)
+	return swapBackups(changes), nil
+}
+
+// stage writes the new file under its temporary name.
+func (c tlsFileChange) stage() error {
+	os.Remove(c.Staged)
+	switch {
+	case c.LinkTarget != "":
+		// the link must not outlive what it points to
+		if err := syncFile(c.LinkTarget); err != nil {
+			return err
+		}
+		return os.Symlink(c.LinkTarget, c.Staged)
+	case c.Source != "":
+		fi, err := os.Stat(c.Source)
+		if err != nil {
+			return err
+		}
+		return copyFile(c.Source, c.Staged, fi.Mode()&os.ModePerm)
+	default:
+		perm := os.FileMode(0o644)
+		if fi, err := os.Stat(c.Path); err == nil {
+			perm = fi.Mode() & os.ModePerm
+		}
+		return writeFileSync(c.Staged, c.Contents, perm)
+	}
+}
+
+func swapBackups(changes []tlsFileChange) []tlsFileBackup {
+	backups := make([]tlsFileBackup, 0, len(changes))
+	for _, c := range changes {
+		backups = append(backups, c.Backup)
+	}
+
+	return backups
+}
+
+// recoverTLSFiles repairs a swap that was interrupted, if no run holds the run
+// lock. A run holding it may be in the middle of a swap, and recovers one
+// left behind itself once it takes the lock.
+func recoverTLSFiles(runDir, outputDir string, history historyJournal) error {
+	journal := filepath.Join(runDir, swapJournalFile)
+	if _, err := os.Lstat(journal); errors.Is(err, fs.ErrNotExist) && len(stagedFiles(outputDir)) == 0 {
+		return nil
+	}
+
+	lock, err := acquireRunLock(context.Background(), runDir, "recover", false)
+	if exitCode(err) == ExitLockHeld {
+		slog.Debug("a run is in progress, not recovering its certificate swap", slog.Any("error", err))
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	return recoverSwap(runDir, outputDir, history)
+}
+
+// recoverSwap repairs a swap that was interrupted. If every file was already
+// replaced, the swap is kept; otherwise the previous files are put back, so
+// the key and certificate always belong together. Staged files left behind
+// are removed. Only a run holding the run lock swaps files, so the caller,
+// which holds it, knows whatever is left was interrupted.
+func recoverSwap(runDir, outputDir string, history historyJournal) error {
+	journal := filepath.Join(runDir, swapJournalFile)
+	swap, err := readSwapJournal(journal)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err = finishSwap(journal, swap, history); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range stagedFiles(outputDir) {
+		slog.Info("removing file left by an interrupted swap", slog.String("path", path))
+		os.Remove(path)
+	}
+
+	return nil
+}
+
+func finishSwap(journal string, swap tlsFileSwap, history historyJournal) error {
+	entry := historyEntry{Action: historyActionRecover, Backups: swapBackups(swap.Changes)}
+	for _, c := range swap.Changes {
+		if filepath.Base(c.Path) == certFile && c.LinkTarget != "" {
+			entry.NewHash = strings.TrimSuffix(filepath.Base(c.LinkTarget), ".pem")
+		}
+	}
+
+	complete := true
+	for _, c := range swap.Changes {
+		if _, err := os.Lstat(c.Staged); err == nil {
+			complete = false
+		}
+	}
+
+	if complete {
+		slog.Warn("an interrupted certificate swap had replaced every file, keeping it", slog.Time("started-at", swap.StartedAt))
+		history.record(entry, nil)
+		return removeSwapJournal(journal)
+	}
+
+	slog.Warn("restoring the previous certificate after an interrupted swap", slog.Time("started-at", swap.StartedAt))
+	if err := restoreTLSFiles(entry.Backups); err != nil {
+		err = fmt.Errorf("could not recover from the certificate swap interrupted at %s: %w", swap.StartedAt.Format(time.RFC3339), err)
+		history.record(entry, err)
+		return err
+	}
+
+	for _, c := range swap.Changes {
+		os.Remove(c.Staged)
+	}
+
+	history.record(entry, fmt.Errorf("%w an interrupted certificate swap", errRolledBack))
+	return removeSwapJournal(journal)
+}
+
+// stagedFiles lists the files staged for outputDir by any run.
+func stagedFiles(outputDir string) []string {
+	var staged []string
+	for _, name := range []string{privateKeyFile, certFile, castore} {
+		paths, _ := filepath.Glob(filepath.Join(outputDir, name+".*.tmp"))
+		for _, path := range paths {
+			if _, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), name+"."), ".tmp")); err == nil {
+				staged = append(staged, path)
+			}
+		}
+	}
+
+	return staged
+}
+
+// restoreTLSFiles puts back the files recorded in backups, last first. Each
+// file is replaced atomically and never written through, since a symlink
+// would lead to the stored certificate it points to.
+func restoreTLSFiles(backups []tlsFileBackup) error {
+	var errs []error
+	for i := len(backups) - 1; i >= 0; i-- {
+		b := backups[i]
+
+		var err error
+		switch {
+		case b.LinkTarget != "":
+			err = replaceWithSymlink(b.LinkTarget, b.Path)
+		case b.BackupPath != "":
+			err = replaceWithCopy(b.BackupPath, b.Path)
+		default:
+			if err = os.Remove(b.Path); errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			}
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not restore %s: %w", b.Path, err))
+		}
+	}
+
+	for _, dir := range backupDirs(backups) {
+		syncDir(dir)
+	}
+
+	return errors.Join(errs...)
+}
+
+func backupDirs(backups []tlsFileBackup) []string {
+	var dirs []string
+	for _, b := range backups {
+		if dir := filepath.Dir(b.Path); !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return dirs
+}
+
+func syncDirs(changes []tlsFileChange) {
+	for _, dir := range backupDirs(swapBackups(changes)) {
+		syncDir(dir)
+	}
+}
+
+// replaceWithSymlink atomically replaces path with a symlink to target.
+func replaceWithSymlink(target, path string) error {
+	tmp := stagedPath(path)
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// replaceWithCopy atomically replaces path with a copy of src.
+func replaceWithCopy(src, path string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	tmp := stagedPath(path)
+	os.Remove(tmp)
+	if err = copyFile(src, tmp, fi.Mode()&os.ModePerm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// stagedPath is where the replacement for path is written before it is
+// renamed over it. The PID tells which run wrote it.
+func stagedPath(path string) string {
+	return fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+}
+
+func writeSwapJournal(path string, swap tlsFileSwap) error {
+	contents, err := json.Marshal(swap)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err = writeFileSync(tmp, contents, 0o600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+func readSwapJournal(path string) (tlsFileSwap, error) {
+	var swap tlsFileSwap
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return swap, err
+	}
+
+	if err = json.Unmarshal(contents, &swap); err != nil {
+		return swap, fmt.Errorf("could not parse swap journal %s: %w", path, err)
+	}
+
+	return swap, nil
+}
+
+func removeSwapJournal(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// writeFileSync writes a new file and flushes it to disk.
+func writeFileSync(path string, contents []byte, perm os.FileMode) error {
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err = fp.Write(contents); err == nil {
+		err = fp.Sync()
+	}
+
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func syncFile(path string) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	return fp.Sync()
+}
+
+// syncDir makes renames in dir durable. Not every filesystem supports syncing
+// a directory, and the rename has happened either way, so errors are only
+// logged.
+func syncDir(dir string) {
+	if err := syncFile(dir); err != nil && !errors.Is(err, syscall.EINVAL) {
+		slog.Debug("could not sync directory", slog.String("dir", dir), slog.Any("error", err))
+	}
+}
+
+// processAlive tells whether another process with pid runs. This process
+// cannot have left anything behind, so its own PID was reused.
+func processAlive(pid int) bool {
+	if pid <= 0 || pid == os.Getpid() {
+		return false
+	}
+
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	// a process of another user is still a process
+	err = proc.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
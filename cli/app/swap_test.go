@@ -0,0 +1,220 @@
+package app
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// interruptedSwap stages new files for outputDir and writes the journal the
+// way swapTLSFiles does, then renames only the first renamed files over their
+// targets, as if the process died there.
+func interruptedSwap(runDir, outputDir string, installed acmeCertWithPath, renamed int) []tlsFileChange {
+	changes := []tlsFileChange{
+		{Path: filepath.Join(outputDir, privateKeyFile), LinkTarget: installed.KeyPath},
+		{Path: filepath.Join(outputDir, certFile), LinkTarget: installed.PEMPath},
+		{Path: filepath.Join(outputDir, castore), Contents: []byte("vmware ca\nissuer ca\n")},
+	}
+
+	for i := range changes {
+		c := &changes[i]
+		var err error
+		c.Backup, err = backupFile(c.Path)
+		Expect(err).NotTo(HaveOccurred())
+		c.Staged = stagedPath(c.Path)
+		Expect(c.stage()).To(Succeed())
+	}
+
+	Expect(os.MkdirAll(runDir, 0o700)).To(Succeed())
+	Expect(writeSwapJournal(filepath.Join(runDir, swapJournalFile), tlsFileSwap{StartedAt: time.Now(), Changes: changes})).To(Succeed())
+
+	for _, c := range changes[:renamed] {
+		Expect(os.Rename(c.Staged, c.Path)).To(Succeed())
+	}
+
+	return changes
+}
+
+func writeVMwareFiles(outputDir string, original acmeCertWithPath) {
+	for dst, src := range map[string]string{certFile: original.PEMPath, privateKeyFile: original.KeyPath} {
+		contents, err := os.ReadFile(src)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(outputDir, dst), contents, 0o600)).To(Succeed())
+	}
+	Expect(os.WriteFile(filepath.Join(outputDir, castore), []byte("vmware ca\n"), 0o644)).To(Succeed())
+}
+
+func TestRecoverInterruptedSwap(t *testing.T) {
+	RegisterTestingT(t)
+
+	baseDir, certsDir, outputDir := t.TempDir(), t.TempDir(), t.TempDir()
+	runDir := filepath.Join(baseDir, "run")
+	now := time.Now()
+	original := writeTestCertificate(certsDir, "vmware", now, now.Add(time.Hour))
+	installed := writeTestCertificate(certsDir, "aa11", now, now.Add(time.Hour))
+	writeVMwareFiles(outputDir, original)
+
+	// the key was switched, the certificate was not
+	changes := interruptedSwap(runDir, outputDir, installed, 1)
+	Expect(os.Readlink(filepath.Join(outputDir, privateKeyFile))).To(Equal(installed.KeyPath))
+
+	history := newHistoryJournal(RunOptions{BaseDir: baseDir}, "status")
+	journal := filepath.Join(runDir, swapJournalFile)
+
+	// the run holding the lock may still be swapping
+	lock, err := acquireRunLock(context.Background(), runDir, "provision", false)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(recoverTLSFiles(runDir, outputDir, history)).To(Succeed())
+	Expect(os.Readlink(filepath.Join(outputDir, privateKeyFile))).To(Equal(installed.KeyPath))
+	Expect(journal).To(BeAnExistingFile())
+	for _, c := range changes[1:] {
+		Expect(c.Staged).To(BeAnExistingFile())
+	}
+	lock.release()
+
+	// once the lock is free the swap was interrupted, even if its PID was
+	// reused by a process that still runs
+	swap, err := readSwapJournal(journal)
+	Expect(err).NotTo(HaveOccurred())
+	swap.PID = os.Getppid()
+	Expect(writeSwapJournal(journal, swap)).To(Succeed())
+	Expect(recoverTLSFiles(runDir, outputDir, history)).To(Succeed())
+
+	for dst, src := range map[string]string{certFile: original.PEMPath, privateKeyFile: original.KeyPath} {
+		fi, err := os.Lstat(filepath.Join(outputDir, dst))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fi.Mode().IsRegular()).To(BeTrue())
+
+		want, err := os.ReadFile(src)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.ReadFile(filepath.Join(outputDir, dst))).To(Equal(want))
+	}
+	Expect(os.ReadFile(filepath.Join(outputDir, castore))).To(BeEquivalentTo("vmware ca\n"))
+
+	for _, c := range changes {
+		Expect(c.Staged).NotTo(BeAnExistingFile())
+	}
+	Expect(journal).NotTo(BeAnExistingFile())
+
+	entries, err := readHistory(history.path)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(entries).To(HaveLen(1))
+	Expect(entries[0].Action).To(Equal(historyActionRecover))
+	Expect(entries[0].Outcome).To(Equal(historyOutcomeRolledBack))
+	Expect(entries[0].NewHash).To(Equal("aa11"))
+
+	// nothing left to do
+	Expect(recoverTLSFiles(runDir, outputDir, history)).To(Succeed())
+	Expect(readHistory(history.path)).To(HaveLen(1))
+}
+
+func TestRecoverCompletedSwap(t *testing.T) {
+	RegisterTestingT(t)
+
+	baseDir, certsDir, outputDir := t.TempDir(), t.TempDir(), t.TempDir()
+	runDir := filepath.Join(baseDir, "run")
+	now := time.Now()
+	original := writeTestCertificate(certsDir, "vmware", now, now.Add(time.Hour))
+	installed := writeTestCertificate(certsDir, "aa11", now, now.Add(time.Hour))
+	writeVMwareFiles(outputDir, original)
+
+	// every file was switched, only the journal is left
+	interruptedSwap(runDir, outputDir, installed, 3)
+
+	history := newHistoryJournal(RunOptions{BaseDir: baseDir}, "status")
+	Expect(recoverTLSFiles(runDir, outputDir, history)).To(Succeed())
+	Expect(os.Readlink(filepath.Join(outputDir, privateKeyFile))).To(Equal(installed.KeyPath))
+	Expect(os.Readlink(filepath.Join(outputDir, certFile))).To(Equal(installed.PEMPath))
+	Expect(os.ReadFile(filepath.Join(outputDir, castore))).To(BeEquivalentTo("vmware ca\nissuer ca\n"))
+	Expect(filepath.Join(runDir, swapJournalFile)).NotTo(BeAnExistingFile())
+
+	entries, err := readHistory(history.path)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(entries).To(HaveLen(1))
+	Expect(entries[0].Outcome).To(Equal(historyOutcomeSuccess))
+}
+
+func TestSwapTLSFiles(t *testing.T) {
+	RegisterTestingT(t)
+
+	baseDir, certsDir, outputDir := t.TempDir(), t.TempDir(), t.TempDir()
+	runDir := filepath.Join(baseDir, "run")
+	now := time.Now()
+	original := writeTestCertificate(certsDir, "vmware", now, now.Add(time.Hour))
+	installed := writeTestCertificate(certsDir, "aa11", now, now.Add(time.Hour))
+	writeVMwareFiles(outputDir, original)
+
+	backups, err := swapTLSFiles(runDir, []tlsFileChange{
+		{Path: filepath.Join(outputDir, privateKeyFile), LinkTarget: installed.KeyPath},
+		{Path: filepath.Join(outputDir, certFile), LinkTarget: installed.PEMPath},
+		// a change that cannot be staged fails the whole swap
+		{Path: filepath.Join(outputDir, "missing.pem"), Source: filepath.Join(certsDir, "missing.pem")},
+	})
+	Expect(err).To(HaveOccurred())
+	Expect(backups).To(BeNil())
+
+	fi, err := os.Lstat(filepath.Join(outputDir, certFile))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(fi.Mode().IsRegular()).To(BeTrue())
+	Expect(filepath.Glob(filepath.Join(outputDir, "*.tmp"))).To(BeEmpty())
+	Expect(filepath.Join(runDir, swapJournalFile)).NotTo(BeAnExistingFile())
+
+	// staged files are left to the run holding the lock, and removed once
+	// nothing holds it, whichever process wrote them
+	staged := filepath.Join(outputDir, certFile+".1.tmp")
+	other := filepath.Join(outputDir, certFile+".backup.tmp")
+	Expect(os.WriteFile(staged, nil, 0o600)).To(Succeed())
+	Expect(os.WriteFile(other, nil, 0o600)).To(Succeed())
+	history := historyJournal{path: filepath.Join(baseDir, historyFile)}
+
+	lock, err := acquireRunLock(context.Background(), runDir, "provision", false)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(recoverTLSFiles(runDir, outputDir, history)).To(Succeed())
+	Expect(staged).To(BeAnExistingFile())
+	lock.release()
+
+	Expect(recoverTLSFiles(runDir, outputDir, history)).To(Succeed())
+	Expect(staged).NotTo(BeAnExistingFile())
+	Expect(other).To(BeAnExistingFile())
+}
+
+func TestSwapRefusedUntilRecovered(t *testing.T) {
+	RegisterTestingT(t)
+
+	baseDir, certsDir, outputDir := t.TempDir(), t.TempDir(), t.TempDir()
+	runDir := filepath.Join(baseDir, "run")
+	now := time.Now()
+	original := writeTestCertificate(certsDir, "vmware", now, now.Add(time.Hour))
+	installed := writeTestCertificate(certsDir, "aa11", now, now.Add(time.Hour))
+	writeVMwareFiles(outputDir, original)
+
+	// a run killed after switching the key left its journal behind
+	interruptedSwap(runDir, outputDir, installed, 1)
+
+	lock, err := acquireRunLock(context.Background(), runDir, "provision", false)
+	Expect(err).NotTo(HaveOccurred())
+	defer lock.release()
+
+	changes := []tlsFileChange{
+		{Path: filepath.Join(outputDir, privateKeyFile), LinkTarget: installed.KeyPath},
+		{Path: filepath.Join(outputDir, certFile), LinkTarget: installed.PEMPath},
+	}
+	_, err = swapTLSFiles(runDir, changes)
+	Expect(err).To(MatchError(ContainSubstring("not recovered")))
+	Expect(os.Readlink(filepath.Join(outputDir, privateKeyFile))).To(Equal(installed.KeyPath))
+	Expect(filepath.Join(outputDir, certFile)).To(BeARegularFile())
+
+	history := newHistoryJournal(RunOptions{BaseDir: baseDir}, "provision")
+	Expect(recoverSwap(runDir, outputDir, history)).To(Succeed())
+	Expect(filepath.Join(outputDir, privateKeyFile)).To(BeARegularFile())
+	Expect(filepath.Join(runDir, swapJournalFile)).NotTo(BeAnExistingFile())
+
+	_, err = swapTLSFiles(runDir, changes)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(os.Readlink(filepath.Join(outputDir, privateKeyFile))).To(Equal(installed.KeyPath))
+	Expect(os.Readlink(filepath.Join(outputDir, certFile))).To(Equal(installed.PEMPath))
+}
@@ -6,12 +6,15 @@ require (
 	github.com/alecthomas/kong v1.13.0
 	github.com/jghiloni/esxi-acme-mgmt/plugins/common v0.0.1
 	github.com/mholt/acmez/v3 v3.1.4
+	github.com/onsi/gomega v1.39.1
 	github.com/samber/slog-syslog/v2 v2.5.3
 )
 
 require (
+	github.com/google/go-cmp v0.7.0 // indirect
 	github.com/samber/lo v1.52.0 // indirect
 	github.com/samber/slog-common v0.20.0 // indirect
+	go.yaml.in/yaml/v3 v3.0.4 // indirect
 	golang.org/x/crypto v0.47.0 // indirect
 	golang.org/x/net v0.49.0 // indirect
 	golang.org/x/text v0.33.0 // indirect
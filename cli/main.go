@@ -7,32 +7,24 @@ import (
 	"log/syslog"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/jghiloni/esxi-acme-mgmt/cli/app"
 )
 
 func main() {
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
-	
+
 	// we always connect to the syslog service if we can, even if logging is
 	// disabled
-	var (
-		syslogWriter io.WriteCloser
-		err          error
-	)
-
-	syslogWriter, err = syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, app.Name)
+	var syslogWriter io.WriteCloser = os.Stderr
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, app.Name)
 	if err != nil {
 		slog.With(slog.Any("error", err)).Warn("could not connect to local syslog service, falling back to stderr")
-	}
-
-	if syslogWriter != nil {
-		defer syslogWriter.Close()
-	}
-
-	if syslogWriter == nil {
-		syslogWriter = os.Stderr
+	} else {
+		syslogWriter = w
+		defer w.Close()
 	}
 
 	// for really running, we want the defaults
@@ -1,14 +1,12 @@
 package main
 
 import (
-	"context"
+	"fmt"
+	"os"
 
-	"github.com/alecthomas/kong"
-	"github.com/caddyserver/certmagic"
 	"github.com/jghiloni/esxi-acme-mgmt/plugins/common"
+	"github.com/jghiloni/esxi-acme-mgmt/plugins/common/dnsbridge"
 	"github.com/libdns/cloudflare"
-	"github.com/mholt/acmez/v3"
-	"github.com/mholt/acmez/v3/acme"
 )
 
 const providerName = "cloudflare"
@@ -18,39 +16,19 @@ type providerArgs struct {
 	ZoneToken string `env:"CLOUDFLARE_ZONE_TOKEN" optional:"true"`
 }
 
-type cloudflarePluginProvider struct {
-	delegate acmez.Solver
-}
-
-func (r *cloudflarePluginProvider) Present(ctx context.Context, challenge acme.Challenge) error {
-	return r.delegate.Present(ctx, challenge)
-}
-
-func (r *cloudflarePluginProvider) CleanUp(ctx context.Context, challenge acme.Challenge) error {
-	return r.delegate.CleanUp(ctx, challenge)
-}
-
-func (*cloudflarePluginProvider) Name() string {
-	return providerName
-}
-
-func (r *cloudflarePluginProvider) WithArgs(args []string) {
-	var parsedArgs providerArgs
-	k := kong.Must(&parsedArgs)
-	k.Parse(args)
-
-	r.delegate = &certmagic.DNS01Solver{
-		DNSManager: certmagic.DNSManager{
-			DNSProvider: &cloudflare.Provider{
-				APIToken:  parsedArgs.APIToken,
-				ZoneToken: parsedArgs.ZoneToken,
-			},
-		},
+func newCloudflareProvider(args *providerArgs) dnsbridge.RecordManager {
+	return &cloudflare.Provider{
+		APIToken:  args.APIToken,
+		ZoneToken: args.ZoneToken,
 	}
 }
 
-var DNSProvider common.Provider = new(cloudflarePluginProvider)
+var DNSProvider common.Provider = dnsbridge.New(providerName, newCloudflareProvider)
 
 func main() {
-	// no op for a plugin
+	// only reached when built as an executable provider rather than a Go plugin
+	if err := common.Serve(DNSProvider); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,90 @@
+// Package dnsbridge turns any libdns provider into a common.Provider. It lives
+// in its own package so the CLI, which only imports common, does not link
+// certmagic and libdns and force Go plugins to match their versions.
+package dnsbridge
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/alecthomas/kong"
+	"github.com/caddyserver/certmagic"
+	"github.com/jghiloni/esxi-acme-mgmt/plugins/common"
+	"github.com/libdns/libdns"
+	"github.com/mholt/acmez/v3/acme"
+)
+
+// RecordManager is the part of a libdns provider needed to publish and remove
+// DNS-01 challenge records.
+type RecordManager interface {
+	libdns.RecordAppender
+	libdns.RecordDeleter
+}
+
+// ManagerConfigurer may be implemented by a RecordManager that needs to tune
+// how certmagic finds zones and checks propagation, e.g. by pointing it at a
+// specific nameserver.
+type ManagerConfigurer interface {
+	ConfigureDNSManager(*certmagic.DNSManager)
+}
+
+// New returns a Provider called name. WithArgs parses its arguments with kong
+// into a new T, so T's fields can use the usual kong tags (env, default,
+// optional, ...), and newRecordManager builds the libdns provider from them.
+func New[T any](name string, newRecordManager func(args *T) RecordManager) common.Provider {
+	return &provider[T]{
+		name:             name,
+		newRecordManager: newRecordManager,
+	}
+}
+
+type provider[T any] struct {
+	name             string
+	newRecordManager func(*T) RecordManager
+	delegate         *certmagic.DNS01Solver
+}
+
+func (p *provider[T]) Name() string {
+	return p.name
+}
+
+func (p *provider[T]) WithArgs(args []string) {
+	parsedArgs := new(T)
+	k := kong.Must(parsedArgs, kong.Name(p.name))
+	if _, err := k.Parse(args); err != nil {
+		slog.Warn("could not parse provider arguments", slog.String("provider-name", p.name), slog.Any("error", err))
+	}
+
+	recordManager := p.newRecordManager(parsedArgs)
+	p.delegate = &certmagic.DNS01Solver{
+		DNSManager: certmagic.DNSManager{
+			DNSProvider: recordManager,
+		},
+	}
+
+	if configurer, ok := recordManager.(ManagerConfigurer); ok {
+		configurer.ConfigureDNSManager(&p.delegate.DNSManager)
+	}
+}
+
+func (p *provider[T]) Present(ctx context.Context, challenge acme.Challenge) error {
+	return p.solver().Present(ctx, challenge)
+}
+
+func (p *provider[T]) Wait(ctx context.Context, challenge acme.Challenge) error {
+	return p.solver().Wait(ctx, challenge)
+}
+
+func (p *provider[T]) CleanUp(ctx context.Context, challenge acme.Challenge) error {
+	return p.solver().CleanUp(ctx, challenge)
+}
+
+// solver returns the configured solver, falling back to one built from the
+// environment alone if WithArgs was never called.
+func (p *provider[T]) solver() *certmagic.DNS01Solver {
+	if p.delegate == nil {
+		p.WithArgs([]string{})
+	}
+
+	return p.delegate
+}
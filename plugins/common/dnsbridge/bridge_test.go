@@ -0,0 +1,138 @@
+package dnsbridge_test
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/jghiloni/esxi-acme-mgmt/plugins/common/dnsbridge"
+	"github.com/libdns/libdns"
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+	"github.com/miekg/dns"
+	. "github.com/onsi/gomega"
+)
+
+type fakeArgs struct {
+	Resolver string `required:"" help:"The nameserver to find zones with"`
+}
+
+// fakeZones is a libdns provider that keeps the records of every zone in
+// memory.
+type fakeZones struct {
+	resolver string
+
+	mu      sync.Mutex
+	records map[string][]libdns.RR
+}
+
+func (f *fakeZones) AppendRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, rec := range recs {
+		f.records[zone] = append(f.records[zone], rec.RR())
+	}
+	return recs, nil
+}
+
+func (f *fakeZones) DeleteRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, rec := range recs {
+		f.records[zone] = slices.DeleteFunc(f.records[zone], func(rr libdns.RR) bool {
+			return rr.Name == rec.RR().Name && rr.Type == rec.RR().Type && rr.Data == rec.RR().Data
+		})
+	}
+	return recs, nil
+}
+
+// ConfigureDNSManager finds zones with the test nameserver and skips the
+// propagation check, which would need the records to be served.
+func (f *fakeZones) ConfigureDNSManager(m *certmagic.DNSManager) {
+	m.Resolvers = []string{f.resolver}
+	m.PropagationTimeout = -1
+}
+
+func (f *fakeZones) zone(name string) []libdns.RR {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return slices.Clone(f.records[name])
+}
+
+// serveZone runs a nameserver that is authoritative for zone only, and
+// returns its address.
+func serveZone(t *testing.T, zone string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+
+		q := req.Question[0]
+		switch {
+		case q.Name == zone && q.Qtype == dns.TypeSOA:
+			resp.Answer = append(resp.Answer, &dns.SOA{
+				Hdr:    dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+				Ns:     "ns1." + zone,
+				Mbox:   "hostmaster." + zone,
+				Serial: 1,
+			})
+		case !dns.IsSubDomain(zone, q.Name):
+			resp.Rcode = dns.RcodeRefused
+		default:
+			resp.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(resp)
+	})}
+
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	<-started
+
+	return conn.LocalAddr().String()
+}
+
+func TestBridge(t *testing.T) {
+	RegisterTestingT(t)
+
+	resolver := serveZone(t, "example.com.")
+	zones := &fakeZones{records: map[string][]libdns.RR{}}
+	provider := dnsbridge.New("fake", func(args *fakeArgs) dnsbridge.RecordManager {
+		zones.resolver = args.Resolver
+		return zones
+	})
+	Expect(provider.Name()).To(Equal("fake"))
+	provider.WithArgs([]string{"--resolver", resolver})
+	Expect(zones.resolver).To(Equal(resolver))
+
+	challenge := acme.Challenge{
+		Type:             acme.ChallengeTypeDNS01,
+		Identifier:       acme.Identifier{Type: "dns", Value: "host.sub.example.com"},
+		Token:            "token",
+		KeyAuthorization: "token.thumbprint",
+	}
+
+	ctx := context.Background()
+	Expect(provider.Present(ctx, challenge)).To(Succeed())
+
+	// the name is split into the zone the nameserver is authoritative for and
+	// a record name relative to it
+	Expect(zones.zone("example.com.")).To(ConsistOf(And(
+		HaveField("Name", "_acme-challenge.host.sub"),
+		HaveField("Type", "TXT"),
+		HaveField("Data", challenge.DNS01KeyAuthorization()),
+	)))
+
+	Expect(provider.(acmez.Waiter).Wait(ctx, challenge)).To(Succeed())
+	Expect(provider.CleanUp(ctx, challenge)).To(Succeed())
+	Expect(zones.zone("example.com.")).To(BeEmpty())
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"os"
 	"path/filepath"
 	"plugin"
 	"strings"
@@ -11,28 +12,45 @@ import (
 
 const SymbolName = "DNSProvider"
 
+// PluginPrefix is the prefix plugin files may carry before the provider name,
+// e.g. esxi-acme-route53.
+const PluginPrefix = "esxi-acme-"
+
+// LoadProvider finds the provider named providerName in pluginDir and passes
+// it providerArgs. Go plugins (<name>.so) are preferred; if one cannot be
+// opened, for instance because it was built with a different toolchain, an
+// executable named <name> speaking the stdio RPC protocol is used instead.
+// Plugins named PluginPrefix<name> are found as well.
+// Executable providers implement io.Closer and should be closed after use.
 func LoadProvider(pluginDir string, providerName string, providerArgs []string) (Provider, error) {
-	var provider Provider
-	p, err := plugin.Open(filepath.Join(pluginDir, providerName+".so"))
-	if err != nil {
-		provider, err = findProvider(pluginDir, providerName)
+	p, soErr := plugin.Open(filepath.Join(pluginDir, providerName+".so"))
+	if soErr != nil {
+		provider, err := loadProviderFromExecutable(filepath.Join(pluginDir, providerName), providerName)
+		if err != nil {
+			provider, err = findProvider(pluginDir, providerName)
+		}
+
 		if err != nil {
-			return nil, fmt.Errorf("could not provider %s: %w", providerName, err)
+			return nil, fmt.Errorf("could not load provider %s: %w", providerName, errors.Join(soErr, err))
 		}
 		provider.WithArgs(providerArgs)
 		return provider, nil
 	}
 
-	provider, err = loadProviderFromPlugin(p, providerName)
+	provider, err := loadProviderFromPlugin(p, providerName)
 	if provider != nil {
 		provider.WithArgs(providerArgs)
 	}
 	return provider, err
 }
 
+// findProvider looks for the provider among the plugins in pluginDir named
+// for it: <name> or PluginPrefix<name>, with or without the .so extension and
+// in any case. Plugins are never opened or run unless their name matches, as
+// both run code of the plugin.
 func findProvider(pluginDir, providerName string) (Provider, error) {
 	logger := slog.With(slog.String("method", "findProvider"), slog.String("provider-name", providerName))
-	pluginFiles, _ := filepath.Glob(filepath.Join(pluginDir, "*.so"))
+	pluginFiles, executables := findPluginFiles(pluginDir, providerName)
 
 	logger.Debug("found plugin files", slog.Any("plugin-files", pluginFiles))
 	var errs []error
@@ -49,9 +67,66 @@ func findProvider(pluginDir, providerName string) (Provider, error) {
 		}
 	}
 
+	logger.Debug("found plugin executables", slog.Any("plugin-executables", executables))
+	for _, exe := range executables {
+		provider, err := loadProviderFromExecutable(exe, providerName)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return provider, nil
+	}
+
+	errs = append(errs, fmt.Errorf("no plugin in %s provides %s", pluginDir, providerName))
 	return nil, errors.Join(errs...)
 }
 
+// findPluginFiles returns the Go plugins and the executables in pluginDir
+// whose names match providerName.
+func findPluginFiles(pluginDir, providerName string) (pluginFiles []string, executables []string) {
+	entries, err := os.ReadDir(pluginDir)
+	if err != nil {
+		return nil, nil
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		isPlugin := filepath.Ext(name) == ".so"
+		base := strings.TrimSuffix(name, ".so")
+		if entry.IsDir() || !strings.EqualFold(base, providerName) && !strings.EqualFold(base, PluginPrefix+providerName) {
+			continue
+		}
+
+		if isPlugin {
+			pluginFiles = append(pluginFiles, filepath.Join(pluginDir, name))
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.Mode()&0o111 == 0 {
+			continue
+		}
+
+		executables = append(executables, filepath.Join(pluginDir, name))
+	}
+
+	return pluginFiles, executables
+}
+
+func loadProviderFromExecutable(path string, providerName string) (Provider, error) {
+	provider, err := startExecProvider(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.EqualFold(provider.Name(), providerName) {
+		provider.Close()
+		return nil, fmt.Errorf("expected provider name %s, found %s", providerName, provider.Name())
+	}
+
+	return provider, nil
+}
+
 func loadProviderFromPlugin(p *plugin.Plugin, providerName string) (Provider, error) {
 	raw, err := p.Lookup(SymbolName)
 	if err != nil {
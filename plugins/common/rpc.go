@@ -0,0 +1,256 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+)
+
+const (
+	// ProtocolVersion is the version of the JSON-RPC protocol spoken between
+	// the CLI and executable providers. It must be bumped whenever a method or
+	// its payload changes incompatibly.
+	ProtocolVersion = 2
+
+	// ProtocolEnvVar is set to ProtocolVersion in the environment of every
+	// executable provider the CLI launches, so the provider knows it should
+	// serve requests instead of acting as a regular command.
+	ProtocolEnvVar = "ESXI_ACME_MGMT_PLUGIN_PROTOCOL"
+
+	rpcServiceName  = "Provider"
+	rpcCloseTimeout = 5 * time.Second
+
+	// rpcCallTimeout bounds challenge calls whose caller set no deadline, so a
+	// provider does not wait for DNS propagation forever.
+	rpcCallTimeout = 10 * time.Minute
+)
+
+var ErrNotLaunchedByCLI = errors.New("this is an esxi-acme-mgmt DNS provider and must be launched by esxi-acme-mgmt")
+
+// Handshake is exchanged when an executable provider is launched so both sides
+// can confirm they speak the same protocol version.
+type Handshake struct {
+	ProtocolVersion int    `json:"protocolVersion"`
+	Name            string `json:"name"`
+}
+
+// Serve exposes provider over stdin and stdout so it can be used as an
+// executable plugin. It blocks until the CLI closes stdin. Nothing else may
+// write to stdout while Serve is running; logs should go to stderr.
+func Serve(provider Provider) error {
+	if os.Getenv(ProtocolEnvVar) == "" {
+		return ErrNotLaunchedByCLI
+	}
+
+	server := rpc.NewServer()
+	if err := server.RegisterName(rpcServiceName, &rpcServer{provider: provider}); err != nil {
+		return err
+	}
+
+	server.ServeCodec(jsonrpc.NewServerCodec(stdioConn{Reader: os.Stdin, Writer: os.Stdout}))
+	return nil
+}
+
+// ChallengeRequest is the payload of the challenge methods. Contexts do not
+// cross the process boundary, so it carries the deadline of the caller's.
+type ChallengeRequest struct {
+	Challenge acme.Challenge `json:"challenge"`
+	Deadline  time.Time      `json:"deadline,omitzero"`
+}
+
+func newChallengeRequest(ctx context.Context, challenge acme.Challenge) ChallengeRequest {
+	deadline, _ := ctx.Deadline()
+	return ChallengeRequest{Challenge: challenge, Deadline: deadline}
+}
+
+// context returns the context the provider handles the request in, which ends
+// at the caller's deadline, or after rpcCallTimeout if it had none.
+func (r ChallengeRequest) context() (context.Context, context.CancelFunc) {
+	deadline := r.Deadline
+	if deadline.IsZero() {
+		deadline = time.Now().Add(rpcCallTimeout)
+	}
+
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+type stdioConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdioConn) Close() error {
+	return nil
+}
+
+type rpcServer struct {
+	provider Provider
+}
+
+func (s *rpcServer) Handshake(clientVersion int, reply *Handshake) error {
+	reply.ProtocolVersion = ProtocolVersion
+	reply.Name = s.provider.Name()
+
+	if clientVersion != ProtocolVersion {
+		return fmt.Errorf("unsupported protocol version %d, provider speaks version %d", clientVersion, ProtocolVersion)
+	}
+
+	return nil
+}
+
+func (s *rpcServer) WithArgs(args []string, _ *struct{}) error {
+	s.provider.WithArgs(args)
+	return nil
+}
+
+func (s *rpcServer) Present(req ChallengeRequest, _ *struct{}) error {
+	ctx, cancel := req.context()
+	defer cancel()
+
+	return s.provider.Present(ctx, req.Challenge)
+}
+
+func (s *rpcServer) Wait(req ChallengeRequest, _ *struct{}) error {
+	waiter, ok := s.provider.(acmez.Waiter)
+	if !ok {
+		return nil
+	}
+
+	ctx, cancel := req.context()
+	defer cancel()
+
+	return waiter.Wait(ctx, req.Challenge)
+}
+
+func (s *rpcServer) CleanUp(req ChallengeRequest, _ *struct{}) error {
+	ctx, cancel := req.context()
+	defer cancel()
+
+	return s.provider.CleanUp(ctx, req.Challenge)
+}
+
+// execProvider is a Provider backed by an executable running Serve. Callers
+// should Close it once they are done so the child process exits.
+type execProvider struct {
+	cmd    *exec.Cmd
+	client *rpc.Client
+	name   string
+}
+
+func startExecProvider(path string) (*execProvider, error) {
+	cmd := exec.Command(path)
+	cmd.Env = append(os.Environ(), ProtocolEnvVar+"="+strconv.Itoa(ProtocolVersion))
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &execProvider{
+		cmd:    cmd,
+		client: jsonrpc.NewClient(stdioPipes{ReadCloser: stdout, WriteCloser: stdin}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcCloseTimeout)
+	defer cancel()
+
+	var hs Handshake
+	if err = p.call(ctx, "Handshake", ProtocolVersion, &hs); err != nil {
+		p.Close()
+		return nil, fmt.Errorf("handshake with %s failed: %w", path, err)
+	}
+
+	if hs.ProtocolVersion != ProtocolVersion {
+		p.Close()
+		return nil, fmt.Errorf("%s speaks protocol version %d, expected %d", path, hs.ProtocolVersion, ProtocolVersion)
+	}
+
+	p.name = hs.Name
+	return p, nil
+}
+
+type stdioPipes struct {
+	io.ReadCloser
+	io.WriteCloser
+}
+
+func (p stdioPipes) Close() error {
+	return errors.Join(p.WriteCloser.Close(), p.ReadCloser.Close())
+}
+
+func (p *execProvider) Name() string {
+	return p.name
+}
+
+func (p *execProvider) WithArgs(args []string) {
+	if args == nil {
+		args = []string{}
+	}
+
+	if err := p.call(context.Background(), "WithArgs", args, &struct{}{}); err != nil {
+		slog.Warn("provider rejected arguments", slog.String("provider-name", p.name), slog.Any("error", err))
+	}
+}
+
+func (p *execProvider) Present(ctx context.Context, challenge acme.Challenge) error {
+	return p.call(ctx, "Present", newChallengeRequest(ctx, challenge), &struct{}{})
+}
+
+func (p *execProvider) Wait(ctx context.Context, challenge acme.Challenge) error {
+	return p.call(ctx, "Wait", newChallengeRequest(ctx, challenge), &struct{}{})
+}
+
+func (p *execProvider) CleanUp(ctx context.Context, challenge acme.Challenge) error {
+	return p.call(ctx, "CleanUp", newChallengeRequest(ctx, challenge), &struct{}{})
+}
+
+// Close closes the provider's stdin, which makes Serve return, and kills the
+// process if it has not exited within a few seconds.
+func (p *execProvider) Close() error {
+	p.client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(rpcCloseTimeout):
+		p.cmd.Process.Kill()
+		return <-done
+	}
+}
+
+func (p *execProvider) call(ctx context.Context, method string, args any, reply any) error {
+	call := p.client.Go(rpcServiceName+"."+method, args, reply, make(chan *rpc.Call, 1))
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-call.Done:
+		return call.Error
+	}
+}
@@ -0,0 +1,136 @@
+package common_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jghiloni/esxi-acme-mgmt/plugins/common"
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+	. "github.com/onsi/gomega"
+)
+
+// fakeProvider accepts a challenge only if its token is the comma-joined list
+// of args it was given, which lets the test check args and challenges survive
+// the trip through the child process.
+type fakeProvider struct {
+	args []string
+}
+
+func (*fakeProvider) Name() string {
+	return "fake"
+}
+
+func (f *fakeProvider) WithArgs(args []string) {
+	f.args = args
+}
+
+func (f *fakeProvider) Present(_ context.Context, challenge acme.Challenge) error {
+	if challenge.Token != strings.Join(f.args, ",") {
+		return fmt.Errorf("unexpected token %q", challenge.Token)
+	}
+
+	return nil
+}
+
+func (f *fakeProvider) CleanUp(context.Context, acme.Challenge) error {
+	return nil
+}
+
+// Wait waits for DNS propagation that never happens, until ctx is done.
+func (f *fakeProvider) Wait(ctx context.Context, _ acme.Challenge) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestMain(m *testing.M) {
+	// the test binary doubles as the executable provider
+	if os.Getenv(common.ProtocolEnvVar) != "" {
+		if err := common.Serve(&fakeProvider{}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestExecutableProvider(t *testing.T) {
+	RegisterTestingT(t)
+
+	exe, err := os.Executable()
+	Expect(err).NotTo(HaveOccurred())
+
+	pluginDir := t.TempDir()
+	Expect(os.Symlink(exe, filepath.Join(pluginDir, "fake"))).To(Succeed())
+
+	provider, err := common.LoadProvider(pluginDir, "fake", []string{"--a", "b"})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(provider.Name()).To(Equal("fake"))
+
+	closer, ok := provider.(io.Closer)
+	Expect(ok).To(BeTrue())
+	defer closer.Close()
+
+	Expect(provider.Present(context.Background(), acme.Challenge{Token: "--a,b"})).To(Succeed())
+	Expect(provider.Present(context.Background(), acme.Challenge{Token: "nope"})).To(MatchError(ContainSubstring("unexpected token")))
+	Expect(provider.CleanUp(context.Background(), acme.Challenge{})).To(Succeed())
+}
+
+func TestExecutableProviderDiscoveredByName(t *testing.T) {
+	RegisterTestingT(t)
+
+	exe, err := os.Executable()
+	Expect(err).NotTo(HaveOccurred())
+
+	// binaries not named for the provider are never run
+	pluginDir := t.TempDir()
+	Expect(os.Symlink(exe, filepath.Join(pluginDir, "some-binary"))).To(Succeed())
+	_, err = common.LoadProvider(pluginDir, "fake", nil)
+	Expect(err).To(MatchError(ContainSubstring("no plugin")))
+
+	Expect(os.Symlink(exe, filepath.Join(pluginDir, common.PluginPrefix+"Fake"))).To(Succeed())
+	provider, err := common.LoadProvider(pluginDir, "fake", nil)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(provider.(io.Closer).Close()).To(Succeed())
+
+	_, err = common.LoadProvider(pluginDir, "missing", nil)
+	Expect(err).To(HaveOccurred())
+}
+
+func TestExecutableProviderDeadline(t *testing.T) {
+	RegisterTestingT(t)
+
+	exe, err := os.Executable()
+	Expect(err).NotTo(HaveOccurred())
+
+	pluginDir := t.TempDir()
+	Expect(os.Symlink(exe, filepath.Join(pluginDir, "fake"))).To(Succeed())
+
+	provider, err := common.LoadProvider(pluginDir, "fake", nil)
+	Expect(err).NotTo(HaveOccurred())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	// from either side, whichever gives up first
+	Expect(provider.(acmez.Waiter).Wait(ctx, acme.Challenge{})).To(MatchError(ContainSubstring("deadline exceeded")))
+
+	// the provider gave up at the same deadline, so it exits as soon as it is
+	// closed instead of being killed
+	started := time.Now()
+	Expect(provider.(io.Closer).Close()).To(Succeed())
+	Expect(time.Since(started)).To(BeNumerically("<", 2*time.Second))
+}
+
+func TestServeRequiresCLI(t *testing.T) {
+	RegisterTestingT(t)
+
+	Expect(common.Serve(&fakeProvider{})).To(MatchError(common.ErrNotLaunchedByCLI))
+}
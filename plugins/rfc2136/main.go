@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jghiloni/esxi-acme-mgmt/plugins/common"
+	"github.com/jghiloni/esxi-acme-mgmt/plugins/rfc2136/plugin"
+)
+
+var DNSProvider = plugin.NewRFC2136Plugin()
+
+func main() {
+	// only reached when built as an executable provider rather than a Go plugin
+	if err := common.Serve(DNSProvider); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
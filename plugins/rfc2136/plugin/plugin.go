@@ -0,0 +1,41 @@
+package plugin
+
+import (
+	"time"
+
+	"github.com/jghiloni/esxi-acme-mgmt/plugins/common"
+	"github.com/jghiloni/esxi-acme-mgmt/plugins/common/dnsbridge"
+)
+
+const providerName = "rfc2136"
+
+type providerArgs struct {
+	Server             string        `env:"RFC2136_SERVER" help:"host[:port] of the nameserver that accepts dynamic updates"`
+	KeyName            string        `env:"RFC2136_TSIG_KEY_NAME" help:"Name of the TSIG key used to sign updates"`
+	KeyAlgorithm       string        `env:"RFC2136_TSIG_ALGORITHM" default:"hmac-sha256" help:"TSIG algorithm, e.g. hmac-sha256 or hmac-sha512"`
+	KeySecret          string        `env:"RFC2136_TSIG_SECRET" help:"Base64 encoded TSIG secret"`
+	Network            string        `env:"RFC2136_NETWORK" default:"udp" enum:"udp,tcp" help:"Transport used to send updates"`
+	TTL                time.Duration `env:"RFC2136_TTL" default:"60s" help:"TTL of the challenge records"`
+	PropagationTimeout time.Duration `env:"RFC2136_PROPAGATION_TIMEOUT" default:"2m" help:"How long to wait for the record to be visible on the server, -1s to skip"`
+}
+
+func newRFC2136Provider(args *providerArgs) dnsbridge.RecordManager {
+	return &Updater{
+		Server:             args.Server,
+		KeyName:            args.KeyName,
+		KeyAlgorithm:       args.KeyAlgorithm,
+		KeySecret:          args.KeySecret,
+		Network:            args.Network,
+		TTL:                args.TTL,
+		PropagationTimeout: args.PropagationTimeout,
+	}
+}
+
+func NewRFC2136Plugin(args ...string) common.Provider {
+	r := dnsbridge.New(providerName, newRFC2136Provider)
+	if len(args) > 0 {
+		r.WithArgs(args)
+	}
+
+	return r
+}
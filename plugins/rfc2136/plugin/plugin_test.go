@@ -0,0 +1,182 @@
+package plugin_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jghiloni/esxi-acme-mgmt/plugins/common"
+	"github.com/jghiloni/esxi-acme-mgmt/plugins/rfc2136/plugin"
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+	"github.com/miekg/dns"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	testZone    = "lab.example."
+	testKeyName = "acme-update."
+	testSecret  = "c2VjcmV0LXRzaWcta2V5LWZvci10ZXN0cw=="
+)
+
+// testServer is a minimal authoritative server for testZone that accepts
+// TSIG-signed updates and answers SOA and TXT queries from memory.
+type testServer struct {
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+func (s *testServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Opcode {
+	case dns.OpcodeUpdate:
+		tsig := r.IsTsig()
+		if tsig == nil || w.TsigStatus() != nil {
+			m.Rcode = dns.RcodeNotAuth
+			w.WriteMsg(m)
+			return
+		}
+
+		for _, rr := range r.Ns {
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				continue
+			}
+
+			name := strings.ToLower(txt.Hdr.Name)
+			value := strings.Join(txt.Txt, "")
+			switch txt.Hdr.Class {
+			case dns.ClassINET:
+				s.records[name] = append(s.records[name], value)
+			case dns.ClassNONE:
+				var kept []string
+				for _, v := range s.records[name] {
+					if v != value {
+						kept = append(kept, v)
+					}
+				}
+				s.records[name] = kept
+			}
+		}
+
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	default:
+		q := r.Question[0]
+		name := strings.ToLower(q.Name)
+		switch {
+		case q.Qtype == dns.TypeSOA && name == testZone:
+			m.Answer = append(m.Answer, &dns.SOA{
+				Hdr:     dns.RR_Header{Name: testZone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+				Ns:      "ns." + testZone,
+				Mbox:    "hostmaster." + testZone,
+				Serial:  1,
+				Refresh: 60,
+				Retry:   60,
+				Expire:  60,
+				Minttl:  60,
+			})
+		case q.Qtype == dns.TypeTXT:
+			for _, v := range s.records[name] {
+				m.Answer = append(m.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+					Txt: []string{v},
+				})
+			}
+		}
+	}
+
+	w.WriteMsg(m)
+}
+
+func (s *testServer) txt(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.records[name]...)
+}
+
+func startTestServer(t *testing.T) (*testServer, string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+
+	zone := &testServer{records: map[string][]string{}}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		Handler:           zone,
+		TsigSecret:        map[string]string{testKeyName: testSecret},
+		NotifyStartedFunc: func() { close(started) },
+		MsgAcceptFunc: func(dh dns.Header) dns.MsgAcceptAction {
+			// the default rejects UPDATE messages
+			if int(dh.Bits>>11)&0xF == dns.OpcodeUpdate {
+				return dns.MsgAccept
+			}
+			return dns.DefaultMsgAcceptFunc(dh)
+		},
+	}
+
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	return zone, pc.LocalAddr().String()
+}
+
+func testChallenge() acme.Challenge {
+	return acme.Challenge{
+		Type:             acme.ChallengeTypeDNS01,
+		Token:            "token",
+		KeyAuthorization: "token.thumbprint",
+		Identifier:       acme.Identifier{Type: "dns", Value: "esxi01.lab.example"},
+	}
+}
+
+func TestPresentAndCleanUp(t *testing.T) {
+	RegisterTestingT(t)
+
+	zone, addr := startTestServer(t)
+	provider := plugin.NewRFC2136Plugin(
+		"--server", addr,
+		"--key-name", testKeyName,
+		"--key-secret", testSecret,
+		"--propagation-timeout", "10s",
+	)
+	Expect(provider.Name()).To(Equal("rfc2136"))
+
+	challenge := testChallenge()
+	recordName := challenge.DNS01TXTRecordName() + "."
+	ctx := context.Background()
+
+	Expect(provider.Present(ctx, challenge)).To(Succeed())
+	Expect(zone.txt(recordName)).To(ConsistOf(challenge.DNS01KeyAuthorization()))
+
+	waiter, ok := provider.(acmez.Waiter)
+	Expect(ok).To(BeTrue())
+	Expect(waiter.Wait(ctx, challenge)).To(Succeed())
+
+	Expect(provider.CleanUp(ctx, challenge)).To(Succeed())
+	Expect(zone.txt(recordName)).To(BeEmpty())
+}
+
+func TestUpdateRejectedWithWrongKey(t *testing.T) {
+	RegisterTestingT(t)
+
+	zone, addr := startTestServer(t)
+	var provider common.Provider = plugin.NewRFC2136Plugin(
+		"--server", addr,
+		"--key-name", testKeyName,
+		"--key-secret", "d3Jvbmc=",
+	)
+
+	challenge := testChallenge()
+	Expect(provider.Present(context.Background(), challenge)).NotTo(Succeed())
+	Expect(zone.txt(challenge.DNS01TXTRecordName() + ".")).To(BeEmpty())
+}
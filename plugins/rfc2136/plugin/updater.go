@@ -0,0 +1,143 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+)
+
+var tsigAlgorithms = map[string]string{
+	"hmac-md5":    dns.HmacMD5,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// Updater is a libdns provider that adds and removes records with RFC 2136
+// UPDATE messages, optionally signed with TSIG.
+type Updater struct {
+	Server             string
+	KeyName            string
+	KeyAlgorithm       string
+	KeySecret          string
+	Network            string
+	TTL                time.Duration
+	PropagationTimeout time.Duration
+}
+
+func (u *Updater) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	rrs, err := u.toRRs(zone, recs)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetUpdate(dns.Fqdn(zone))
+	msg.Insert(rrs)
+
+	if err = u.exchange(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	return recs, nil
+}
+
+func (u *Updater) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	rrs, err := u.toRRs(zone, recs)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetUpdate(dns.Fqdn(zone))
+	msg.Remove(rrs)
+
+	if err = u.exchange(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	return recs, nil
+}
+
+// ConfigureDNSManager points certmagic's zone lookups and propagation checks
+// at the update server, since on-prem zones are often not publicly resolvable.
+func (u *Updater) ConfigureDNSManager(m *certmagic.DNSManager) {
+	m.Resolvers = []string{u.serverAddr()}
+	m.TTL = u.TTL
+	m.PropagationTimeout = u.PropagationTimeout
+	if m.PropagationTimeout < 0 {
+		m.PropagationTimeout = -1
+	}
+}
+
+func (u *Updater) toRRs(zone string, recs []libdns.Record) ([]dns.RR, error) {
+	rrs := make([]dns.RR, 0, len(recs))
+	for _, rec := range recs {
+		rr := rec.RR()
+		hdr := dns.RR_Header{
+			Name:  libdns.AbsoluteName(rr.Name, dns.Fqdn(zone)),
+			Class: dns.ClassINET,
+			Ttl:   uint32(rr.TTL.Seconds()),
+		}
+
+		if strings.EqualFold(rr.Type, "TXT") {
+			hdr.Rrtype = dns.TypeTXT
+			rrs = append(rrs, &dns.TXT{Hdr: hdr, Txt: []string{rr.Data}})
+			continue
+		}
+
+		parsed, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", hdr.Name, hdr.Ttl, rr.Type, rr.Data))
+		if err != nil {
+			return nil, fmt.Errorf("could not convert %s record %s: %w", rr.Type, rr.Name, err)
+		}
+		rrs = append(rrs, parsed)
+	}
+
+	return rrs, nil
+}
+
+func (u *Updater) exchange(ctx context.Context, msg *dns.Msg) error {
+	if u.Server == "" {
+		return errors.New("no RFC 2136 server configured")
+	}
+
+	client := &dns.Client{Net: u.Network}
+	if u.KeyName != "" {
+		alg, ok := tsigAlgorithms[strings.TrimSuffix(strings.ToLower(u.KeyAlgorithm), ".")]
+		if !ok {
+			return fmt.Errorf("unsupported TSIG algorithm %s", u.KeyAlgorithm)
+		}
+
+		keyName := dns.Fqdn(u.KeyName)
+		client.TsigSecret = map[string]string{keyName: u.KeySecret}
+		msg.SetTsig(keyName, alg, 300, time.Now().Unix())
+	}
+
+	resp, _, err := client.ExchangeContext(ctx, msg, u.serverAddr())
+	if err != nil {
+		return fmt.Errorf("could not send update to %s: %w", u.Server, err)
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update rejected by %s: %s", u.Server, dns.RcodeToString[resp.Rcode])
+	}
+
+	return nil
+}
+
+func (u *Updater) serverAddr() string {
+	if _, _, err := net.SplitHostPort(u.Server); err == nil {
+		return u.Server
+	}
+
+	return net.JoinHostPort(u.Server, "53")
+}
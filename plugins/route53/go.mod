@@ -3,8 +3,6 @@ module github.com/jghiloni/esxi-acme-mgmt/plugins/route53
 go 1.25.6
 
 require (
-	github.com/alecthomas/kong v1.13.0
-	github.com/caddyserver/certmagic v0.25.1
 	github.com/jghiloni/esxi-acme-mgmt/plugins/common v0.0.1
 	github.com/libdns/route53 v1.6.0
 	github.com/mholt/acmez/v3 v3.1.4
@@ -12,6 +10,7 @@ require (
 )
 
 require (
+	github.com/alecthomas/kong v1.13.0 // indirect
 	github.com/aws/aws-sdk-go-v2 v1.41.1 // indirect
 	github.com/aws/aws-sdk-go-v2/config v1.32.7 // indirect
 	github.com/aws/aws-sdk-go-v2/credentials v1.19.7 // indirect
@@ -27,6 +26,7 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/ssooidc v1.35.13 // indirect
 	github.com/aws/aws-sdk-go-v2/service/sts v1.41.6 // indirect
 	github.com/aws/smithy-go v1.24.0 // indirect
+	github.com/caddyserver/certmagic v0.25.1 // indirect
 	github.com/caddyserver/zerossl v0.1.4 // indirect
 	github.com/google/go-cmp v0.7.0 // indirect
 	github.com/klauspost/cpuid/v2 v2.3.0 // indirect
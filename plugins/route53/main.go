@@ -1,7 +1,19 @@
 package main
 
-import "github.com/jghiloni/esxi-acme-mgmt/plugins/route53/plugin"
+import (
+	"fmt"
+	"os"
+
+	"github.com/jghiloni/esxi-acme-mgmt/plugins/common"
+	"github.com/jghiloni/esxi-acme-mgmt/plugins/route53/plugin"
+)
 
 var DNSProvider = plugin.NewRoute53Plugin()
 
-func main() {}
+func main() {
+	// only reached when built as an executable provider rather than a Go plugin
+	if err := common.Serve(DNSProvider); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -1,14 +1,9 @@
 package plugin
 
 import (
-	"context"
-
-	"github.com/alecthomas/kong"
-	"github.com/caddyserver/certmagic"
 	"github.com/jghiloni/esxi-acme-mgmt/plugins/common"
+	"github.com/jghiloni/esxi-acme-mgmt/plugins/common/dnsbridge"
 	"github.com/libdns/route53"
-	"github.com/mholt/acmez/v3"
-	"github.com/mholt/acmez/v3/acme"
 )
 
 const providerName = "route53"
@@ -22,45 +17,21 @@ type providerArgs struct {
 	Region          string `env:"AWS_REGION" default:"us-east-1"`
 }
 
-type route53PluginProvider struct {
-	delegate acmez.Solver
-}
-
-func (r *route53PluginProvider) Present(ctx context.Context, challenge acme.Challenge) error {
-	return r.delegate.Present(ctx, challenge)
-}
-
-func (r *route53PluginProvider) CleanUp(ctx context.Context, challenge acme.Challenge) error {
-	return r.delegate.CleanUp(ctx, challenge)
-}
-
-func (*route53PluginProvider) Name() string {
-	return providerName
-}
-
-func (r *route53PluginProvider) WithArgs(args []string) {
-	var parsedArgs providerArgs
-	k := kong.Must(&parsedArgs)
-	k.Parse(args)
-
-	r.delegate = &certmagic.DNS01Solver{
-		DNSManager: certmagic.DNSManager{
-			DNSProvider: &route53.Provider{
-				Region:                  parsedArgs.Region,
-				Profile:                 parsedArgs.Profile,
-				AccessKeyId:             parsedArgs.AccessKeyID,
-				SecretAccessKey:         parsedArgs.SecretAccessKey,
-				SessionToken:            parsedArgs.SessionToken,
-				WaitForRoute53Sync:      false,
-				SkipRoute53SyncOnDelete: true,
-				HostedZoneID:            parsedArgs.HostedZoneID,
-			},
-		},
+func newRoute53Provider(args *providerArgs) dnsbridge.RecordManager {
+	return &route53.Provider{
+		Region:                  args.Region,
+		Profile:                 args.Profile,
+		AccessKeyId:             args.AccessKeyID,
+		SecretAccessKey:         args.SecretAccessKey,
+		SessionToken:            args.SessionToken,
+		WaitForRoute53Sync:      false,
+		SkipRoute53SyncOnDelete: true,
+		HostedZoneID:            args.HostedZoneID,
 	}
 }
 
 func NewRoute53Plugin(args ...string) common.Provider {
-	r := &route53PluginProvider{}
+	r := dnsbridge.New(providerName, newRoute53Provider)
 	if len(args) > 0 {
 		r.WithArgs(args)
 	}